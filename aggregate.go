@@ -1,7 +1,12 @@
 package duckql
 
 import (
+	"math"
 	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/rqlite/sql"
 )
 
 type AggregateFunctionColumn struct {
@@ -16,170 +21,397 @@ func (a *AggregateFunctionColumn) Call(rows ResultRows) ResultRows {
 
 type AggregateFunction func(*AggregateFunctionColumn, ResultRows) ResultRows
 
-var functionMap = map[string]AggregateFunction{
-	"avg":   averageOfColumn,
-	"count": countRows,
-	"max":   maxOfColumn,
-	"min":   minOfColumn,
-	"sum":   sumOfColumn,
-	"total": sumOfColumn,
-}
-
-func averageOfColumn(c *AggregateFunctionColumn, rows ResultRows) ResultRows {
-	var sum float64
-
-	for _, row := range rows {
-		for _, column := range row {
-			if column.Name == c.UnderlyingColumn {
-				switch column.Value.Kind() {
-				case reflect.Float32, reflect.Float64:
-					sum += column.Value.Float()
-				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-					sum += float64(column.Value.Int())
-				}
-				goto nextRow
-			}
+// Accumulator computes the result of an aggregate function over a group of
+// rows. A new Accumulator is made for each group, Step is called with the
+// values of the function's arguments for each row of the group, and Final
+// returns the result. NULL arguments are passed as invalid values.
+type Accumulator interface {
+	Step(args []reflect.Value)
+	Final() reflect.Value
+}
+
+// aggregateFunction is an entry in the registry of built-in aggregate
+// functions, along with the number of arguments it accepts. init makes the
+// Accumulator for a group.
+type aggregateFunction struct {
+	minArgs int
+	maxArgs int
+	init    func() Accumulator
+}
+
+var functionMap = map[string]aggregateFunction{
+	"avg":          {1, 1, func() Accumulator { return &averageAccumulator{} }},
+	"bool_and":     {1, 1, func() Accumulator { return &boolAccumulator{and: true} }},
+	"bool_or":      {1, 1, func() Accumulator { return &boolAccumulator{} }},
+	"count":        {0, 1, func() Accumulator { return &countAccumulator{} }},
+	"group_concat": {1, 2, func() Accumulator { return &concatAccumulator{} }},
+	"max":          {1, 1, func() Accumulator { return &extremeAccumulator{sign: 1} }},
+	"median":       {1, 1, func() Accumulator { return &percentileAccumulator{name: "median", p: 50, fixed: true} }},
+	"min":          {1, 1, func() Accumulator { return &extremeAccumulator{sign: -1} }},
+	"percentile":   {2, 2, func() Accumulator { return &percentileAccumulator{name: "percentile"} }},
+	"stddev":       {1, 1, func() Accumulator { return &varianceAccumulator{stddev: true} }},
+	"string_agg":   {2, 2, func() Accumulator { return &concatAccumulator{} }},
+	"sum":          {1, 1, func() Accumulator { return &sumAccumulator{} }},
+	"total":        {1, 1, func() Accumulator { return &sumAccumulator{total: true} }},
+	"variance":     {1, 1, func() Accumulator { return &varianceAccumulator{} }},
+}
+
+// aggregateFinder is a sql.Visitor which records whether it encounters a
+// call to an aggregate function
+type aggregateFinder struct {
+	s     *SQLizer
+	found bool
+}
+
+func (a *aggregateFinder) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
+	// The aggregates of a subquery belong to the subquery
+	if _, ok := n.(*sql.SelectStatement); ok {
+		return nil, n, nil
+	}
+
+	if call, ok := n.(*sql.Call); ok && a.s.isAggregateCall(call) {
+		a.found = true
+		return nil, n, nil
+	}
+
+	return a, n, nil
+}
+
+func (a *aggregateFinder) VisitEnd(n sql.Node) (sql.Node, error) {
+	return n, nil
+}
+
+// containsAggregate reports whether n contains a call to an aggregate function
+func (s *SQLizer) containsAggregate(n sql.Node) bool {
+	a := aggregateFinder{s: s}
+	if _, err := sql.Walk(&a, n); err != nil {
+		return false
+	}
+
+	return a.found
+}
+
+// extremeCall returns the call to the built-in min() or max() made by exprs,
+// other than calls made by their subqueries, if they make exactly one. The
+// same call written more than once is counted once.
+func (s *SQLizer) extremeCall(exprs ...sql.Expr) *sql.Call {
+	var found *sql.Call
+	var text string
+
+	find := sql.VisitFunc(func(n sql.Node) (sql.Node, error) {
+		call, ok := n.(*sql.Call)
+		if !ok || !s.isAggregateCall(call) {
+			return n, nil
+		}
+
+		name := strings.ToLower(call.Name.Name)
+		if _, registered := s.registeredFunction(name); registered || (name != "min" && name != "max") {
+			return n, nil
+		}
+
+		switch {
+		case found == nil:
+			found, text = call, call.String()
+		case call.String() != text:
+			text = ""
+		}
+		return n, nil
+	})
+
+	for _, expr := range exprs {
+		if expr != nil {
+			_, _ = sql.Walk(&subqueryStopper{find}, expr)
+		}
+	}
+
+	if text == "" {
+		return nil
+	}
+
+	return found
+}
+
+// rowsAccumulator adapts an AggregateFunction, which is given every row of
+// the group at once, to the Accumulator interface
+type rowsAccumulator struct {
+	column AggregateFunctionColumn
+	names  []string
+	rows   ResultRows
+}
+
+func newRowsAccumulator(call *sql.Call, f AggregateFunction) *rowsAccumulator {
+	a := &rowsAccumulator{column: AggregateFunctionColumn{Function: f}}
+	for idx, arg := range call.Args {
+		if ident, ok := arg.(*sql.Ident); ok && idx == 0 {
+			a.column.UnderlyingColumn = ident.Name
 		}
+		a.names = append(a.names, columnName(&sql.ResultColumn{Expr: arg}))
+	}
+
+	return a
+}
+
+func (a *rowsAccumulator) Step(args []reflect.Value) {
+	row := make(ResultRow, len(args))
+	for idx, arg := range args {
+		row[idx] = ResultValue{Name: a.names[idx], Value: arg}
+	}
+
+	a.rows = append(a.rows, row)
+}
+
+func (a *rowsAccumulator) Final() reflect.Value {
+	if a.rows == nil {
+		a.rows = ResultRows{}
+	}
+
+	result := a.column.Call(a.rows)
+	if len(result) == 0 || len(result[0]) == 0 {
+		return null
+	}
+
+	return result[0][0].Value
+}
+
+// countAccumulator implements count(), which counts the rows of the group,
+// or with an argument the rows for which it is not NULL
+type countAccumulator struct {
+	n int64
+}
+
+func (a *countAccumulator) Step(args []reflect.Value) {
+	a.n++
+}
+
+func (a *countAccumulator) Final() reflect.Value {
+	return reflect.ValueOf(a.n)
+}
+
+// sumAccumulator implements sum() and total(). sum() is an integer while
+// every value is one, and NULL if there are no values, whereas total() is
+// always a real and is 0.0 if there are no values.
+type sumAccumulator struct {
+	total bool
+
+	n     int
+	i     int64
+	f     float64
+	isInt bool
+}
 
-	nextRow:
+func (a *sumAccumulator) Step(args []reflect.Value) {
+	if a.n == 0 {
+		a.isInt = true
 	}
+	a.n++
 
-	resultRow := rows[len(rows)-1]
-	resultRow[c.ResultPosition] = ResultValue{
-		Name:  "average",
-		Value: reflect.ValueOf(sum / float64(len(rows))),
+	// Text which is an integer is summed as one, as SQLite does, whereas
+	// any other text makes the sum a real
+	x := applyNumericAffinity(args[0])
+	value := toNumeric(x)
+	if a.isInt && value.isInt && x.Kind() != reflect.String {
+		sum := a.i + value.i
+		if (sum > a.i) != (value.i > 0) {
+			raise("integer overflow")
+		}
+		a.i = sum
+		return
 	}
 
-	return ResultRows{
-		resultRow,
+	if a.isInt {
+		a.isInt = false
+		a.f = float64(a.i)
 	}
+	a.f += value.float()
 }
 
-func countRows(c *AggregateFunctionColumn, rows ResultRows) ResultRows {
-	resultRow := rows[len(rows)-1]
-	resultRow[c.ResultPosition] = ResultValue{
-		Name:  "count",
-		Value: reflect.ValueOf(len(rows)),
+func (a *sumAccumulator) Final() reflect.Value {
+	switch {
+	case a.total && a.isInt:
+		return reflect.ValueOf(float64(a.i))
+	case a.total:
+		return reflect.ValueOf(a.f)
+	case a.n == 0:
+		return null
+	case a.isInt:
+		return reflect.ValueOf(a.i)
 	}
 
-	return ResultRows{
-		resultRow,
+	return reflect.ValueOf(a.f)
+}
+
+// averageAccumulator implements avg(), which is always a real
+type averageAccumulator struct {
+	n   int
+	sum float64
+}
+
+func (a *averageAccumulator) Step(args []reflect.Value) {
+	a.n++
+	a.sum += toNumeric(args[0]).float()
+}
+
+func (a *averageAccumulator) Final() reflect.Value {
+	if a.n == 0 {
+		return null
 	}
+
+	return reflect.ValueOf(a.sum / float64(a.n))
+}
+
+// extremeAccumulator implements min() and max(), ordering values as SQLite
+// does. sign is -1 for the smallest value and 1 for the largest. When it is
+// stepped by stepRow, row is the row of the group the value came from.
+type extremeAccumulator struct {
+	sign  int
+	value reflect.Value
+	row   ResultRow
 }
 
-func maxOfColumn(c *AggregateFunctionColumn, rows ResultRows) ResultRows {
-	var max reflect.Value
-	var maxRow ResultRow
+func (a *extremeAccumulator) Step(args []reflect.Value) {
+	a.stepRow(args, nil)
+}
+
+func (a *extremeAccumulator) stepRow(args []reflect.Value, row ResultRow) {
+	if !a.value.IsValid() || compareValues(args[0], a.value)*a.sign > 0 {
+		a.value, a.row = args[0], row
+	}
+}
 
-	for _, row := range rows {
-		for _, column := range row {
-			if column.Name == c.UnderlyingColumn {
-				if !max.IsValid() {
-					max = column.Value
-					maxRow = row
-					goto nextRow
-				} else {
-					switch column.Value.Kind() {
-					case reflect.Float32, reflect.Float64:
-						if column.Value.Float() > max.Float() {
-							max = column.Value
-							maxRow = row
-						}
-					case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-						if column.Value.Int() > max.Int() {
-							max = column.Value
-							maxRow = row
-						}
-					case reflect.String:
-						if column.Value.String() > max.String() {
-							max = column.Value
-							maxRow = row
-						}
-					}
-					goto nextRow
-				}
-			}
+func (a *extremeAccumulator) Final() reflect.Value {
+	return a.value
+}
+
+// concatAccumulator implements group_concat() and string_agg(), which join
+// the values of the group as text. Each value after the first is preceded
+// by the separator given alongside it, or a comma if there is none.
+type concatAccumulator struct {
+	b strings.Builder
+	n int
+}
+
+func (a *concatAccumulator) Step(args []reflect.Value) {
+	if a.n > 0 {
+		if len(args) > 1 {
+			a.b.WriteString(coerceToString(args[1]))
+		} else {
+			a.b.WriteString(",")
 		}
-	nextRow:
-	}
-
-	return ResultRows{
-		maxRow,
-	}
-}
-
-func minOfColumn(c *AggregateFunctionColumn, rows ResultRows) ResultRows {
-	var min reflect.Value
-	var minRow ResultRow
-
-	for _, row := range rows {
-		for _, column := range row {
-			if column.Name == c.UnderlyingColumn {
-				if !min.IsValid() {
-					min = column.Value
-					minRow = row
-					goto nextRow
-				} else {
-					switch column.Value.Kind() {
-					case reflect.Float32, reflect.Float64:
-						if column.Value.Float() < min.Float() {
-							min = column.Value
-							minRow = row
-						}
-					case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-						if column.Value.Int() < min.Int() {
-							min = column.Value
-							minRow = row
-						}
-					case reflect.String:
-						if column.Value.String() < min.String() {
-							min = column.Value
-							minRow = row
-						}
-					}
-					goto nextRow
-				}
-			}
+	}
+	a.n++
+
+	a.b.WriteString(coerceToString(args[0]))
+}
+
+func (a *concatAccumulator) Final() reflect.Value {
+	if a.n == 0 {
+		return null
+	}
+
+	return reflect.ValueOf(a.b.String())
+}
+
+// boolAccumulator implements bool_and() and bool_or(), which report whether
+// every value of the group, or any value, is true
+type boolAccumulator struct {
+	and   bool
+	value reflect.Value
+}
+
+func (a *boolAccumulator) Step(args []reflect.Value) {
+	if !a.value.IsValid() {
+		a.value = reflect.ValueOf(a.and)
+	}
+
+	if isTrue(args[0]) != a.and {
+		a.value = reflect.ValueOf(!a.and)
+	}
+}
+
+func (a *boolAccumulator) Final() reflect.Value {
+	return a.value
+}
+
+// varianceAccumulator implements variance() and stddev(), the sample
+// variance of the values of the group and its square root, which are NULL
+// unless there are at least two values. The variance is computed with
+// Welford's method.
+type varianceAccumulator struct {
+	stddev bool
+
+	n    int
+	mean float64
+	m2   float64
+}
+
+func (a *varianceAccumulator) Step(args []reflect.Value) {
+	x := toNumeric(args[0]).float()
+
+	a.n++
+	delta := x - a.mean
+	a.mean += delta / float64(a.n)
+	a.m2 += delta * (x - a.mean)
+}
+
+func (a *varianceAccumulator) Final() reflect.Value {
+	if a.n < 2 {
+		return null
+	}
+
+	variance := a.m2 / float64(a.n-1)
+	if a.stddev {
+		return reflect.ValueOf(math.Sqrt(variance))
+	}
+
+	return reflect.ValueOf(variance)
+}
+
+// percentileAccumulator implements percentile(), which interpolates between
+// the values of the group to find the value below which p percent of them
+// fall, and median(), which is percentile() with a p of 50. As in SQLite,
+// the values must be numbers and p must be the same for every row.
+type percentileAccumulator struct {
+	name  string
+	p     float64
+	fixed bool
+
+	values []float64
+}
+
+func (a *percentileAccumulator) Step(args []reflect.Value) {
+	if !a.fixed {
+		p := coerceToFloat(args[1])
+		if p == nil || *p < 0 || *p > 100 {
+			raise("the fraction argument to %s() is not between 0.0 and 100.0", a.name)
 		}
-	nextRow:
-	}
-
-	return ResultRows{
-		minRow,
-	}
-}
-
-func sumOfColumn(c *AggregateFunctionColumn, rows ResultRows) ResultRows {
-	var sum reflect.Value
-	var sumRow ResultRow
-
-	for _, row := range rows {
-		for _, column := range row {
-			if column.Name == c.UnderlyingColumn {
-				if !sum.IsValid() {
-					sum = column.Value
-					goto nextRow
-				} else {
-					switch column.Value.Kind() {
-					case reflect.Float32, reflect.Float64:
-						sum = reflect.ValueOf(sum.Float() + column.Value.Float())
-					case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-						sum = reflect.ValueOf(sum.Int() + column.Value.Int())
-					}
-					goto nextRow
-				}
-			}
+
+		if len(a.values) > 0 && *p != a.p {
+			raise("the fraction argument to %s() is not the same for all input rows", a.name)
 		}
-	nextRow:
+		a.p = *p
 	}
 
-	sumRow = rows[len(rows)-1]
-	sumRow[c.ResultPosition] = ResultValue{
-		Name:  "sum",
-		Value: sum,
+	x := coerceToFloat(args[0])
+	if x == nil {
+		raise("input to %s() is not numeric", a.name)
 	}
 
-	return ResultRows{
-		sumRow,
+	a.values = append(a.values, *x)
+}
+
+func (a *percentileAccumulator) Final() reflect.Value {
+	if len(a.values) == 0 {
+		return null
 	}
+
+	slices.Sort(a.values)
+
+	idx := a.p / 100 * float64(len(a.values)-1)
+	lower := int(idx)
+	if lower == len(a.values)-1 {
+		return reflect.ValueOf(a.values[lower])
+	}
+
+	fraction := idx - float64(lower)
+	return reflect.ValueOf(a.values[lower] + fraction*(a.values[lower+1]-a.values[lower]))
 }
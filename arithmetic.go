@@ -0,0 +1,508 @@
+package duckql
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/rqlite/sql"
+)
+
+// numeric is a value after SQLite's numeric conversion has been applied. It
+// holds either an integer or a real, as indicated by isInt.
+type numeric struct {
+	i     int64
+	f     float64
+	isInt bool
+}
+
+func (n numeric) float() float64 {
+	if n.isInt {
+		return float64(n.i)
+	}
+	return n.f
+}
+
+func (n numeric) value() reflect.Value {
+	if n.isInt {
+		return reflect.ValueOf(n.i)
+	}
+	return reflect.ValueOf(n.f)
+}
+
+// parseNumeric parses the longest numeric prefix of s, as SQLite does when
+// text is used in an arithmetic expression. Text without a numeric prefix
+// converts to the integer 0.
+func parseNumeric(s string) numeric {
+	n, _ := numericPrefix(strings.TrimSpace(s))
+	return n
+}
+
+// numericPrefix parses the longest numeric prefix of s, returning its value
+// and length. The length is 0 if s has no numeric prefix.
+func numericPrefix(s string) (numeric, int) {
+	end := 0
+	if end < len(s) && (s[end] == '+' || s[end] == '-') {
+		end++
+	}
+
+	digits := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+		digits++
+	}
+
+	isInt := true
+	if end < len(s) && s[end] == '.' {
+		isInt = false
+		end++
+		for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+			end++
+			digits++
+		}
+	}
+
+	if digits == 0 {
+		return numeric{isInt: true}, 0
+	}
+
+	if end < len(s) && (s[end] == 'e' || s[end] == 'E') {
+		exp := end + 1
+		if exp < len(s) && (s[exp] == '+' || s[exp] == '-') {
+			exp++
+		}
+		if exp < len(s) && s[exp] >= '0' && s[exp] <= '9' {
+			isInt = false
+			end = exp
+			for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+				end++
+			}
+		}
+	}
+
+	if isInt {
+		if i, err := strconv.ParseInt(s[:end], 10, 64); err == nil {
+			return numeric{i: i, isInt: true}, end
+		}
+	}
+
+	f, _ := strconv.ParseFloat(s[:end], 64)
+	return numeric{f: f}, end
+}
+
+// applyNumericAffinity converts text which is a well-formed integer or real
+// literal, ignoring surrounding whitespace, to the number it spells, as
+// SQLite does when applying NUMERIC affinity. Any other value is unchanged.
+func applyNumericAffinity(x reflect.Value) reflect.Value {
+	if x.Kind() != reflect.String {
+		return x
+	}
+
+	s := strings.TrimSpace(x.String())
+	if n, end := numericPrefix(s); end > 0 && end == len(s) {
+		return n.value()
+	}
+
+	return x
+}
+
+// applyTextAffinity converts a number to its text, as SQLite does when
+// applying TEXT affinity. Any other value is unchanged.
+func applyTextAffinity(x reflect.Value) reflect.Value {
+	if x.Kind() == reflect.String || coerceToFloat(x) == nil {
+		return x
+	}
+
+	return reflect.ValueOf(coerceToString(x))
+}
+
+// parseNumberLit converts the text of a numeric literal into an integer or,
+// if it does not fit in one, a real
+func parseNumberLit(s string) reflect.Value {
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		u, err := strconv.ParseUint(s[2:], 16, 64)
+		if err != nil {
+			raise("hex literal too big: %s", s)
+		}
+		return reflect.ValueOf(int64(u))
+	}
+
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return reflect.ValueOf(i)
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		raise("malformed number: %s", s)
+	}
+	return reflect.ValueOf(f)
+}
+
+// toNumeric applies SQLite's numeric conversion to x
+func toNumeric(x reflect.Value) numeric {
+	switch x.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return numeric{f: x.Float()}
+	case reflect.String:
+		return parseNumeric(x.String())
+	}
+
+	if i := coerceToInt(x); i != nil {
+		return numeric{i: *i, isInt: true}
+	}
+
+	return numeric{isInt: true}
+}
+
+// isTrue reports whether x is considered true in a boolean context. Numbers
+// are true when non-zero, text is converted to a number first, and NULL is
+// never true.
+func isTrue(x reflect.Value) bool {
+	switch x.Kind() {
+	case reflect.Invalid:
+		return false
+	case reflect.Bool:
+		return x.Bool()
+	}
+
+	n := toNumeric(x)
+	if n.isInt {
+		return n.i != 0
+	}
+	return n.f != 0
+}
+
+// evaluateArithmetic applies a binary arithmetic, bitwise or concatenation
+// operator to x and y following SQLite's rules: integer operands produce an
+// integer result unless the operation overflows, while any real operand
+// promotes the operation to floating point.
+func evaluateArithmetic(op sql.Token, x, y reflect.Value) reflect.Value {
+	if !x.IsValid() || !y.IsValid() {
+		return null
+	}
+
+	if op == sql.CONCAT {
+		return reflect.ValueOf(coerceToString(x) + coerceToString(y))
+	}
+
+	a, b := toNumeric(x), toNumeric(y)
+
+	switch op {
+	case sql.BITAND, sql.BITOR, sql.LSHIFT, sql.RSHIFT:
+		i, j := a.i, b.i
+		if !a.isInt {
+			i = int64(a.f)
+		}
+		if !b.isInt {
+			j = int64(b.f)
+		}
+
+		switch op {
+		case sql.BITAND:
+			return reflect.ValueOf(i & j)
+		case sql.BITOR:
+			return reflect.ValueOf(i | j)
+		case sql.LSHIFT:
+			return reflect.ValueOf(shiftLeft(i, j))
+		default:
+			return reflect.ValueOf(shiftLeft(i, -j))
+		}
+	}
+
+	if a.isInt && b.isInt {
+		switch op {
+		case sql.PLUS:
+			if sum := a.i + b.i; (sum > a.i) == (b.i > 0) {
+				return reflect.ValueOf(sum)
+			}
+		case sql.MINUS:
+			if diff := a.i - b.i; (diff < a.i) == (b.i > 0) {
+				return reflect.ValueOf(diff)
+			}
+		case sql.STAR:
+			if a.i == 0 || b.i == 0 {
+				return reflect.ValueOf(int64(0))
+			}
+			if product := a.i * b.i; product/b.i == a.i && !(a.i == -1 && b.i == math.MinInt64) && !(b.i == -1 && a.i == math.MinInt64) {
+				return reflect.ValueOf(product)
+			}
+		case sql.SLASH:
+			if b.i == 0 {
+				return null
+			}
+			if a.i == math.MinInt64 && b.i == -1 {
+				return reflect.ValueOf(-float64(a.i))
+			}
+			return reflect.ValueOf(a.i / b.i)
+		case sql.REM:
+			if b.i == 0 {
+				return null
+			}
+			if b.i == -1 {
+				return reflect.ValueOf(int64(0))
+			}
+			return reflect.ValueOf(a.i % b.i)
+		}
+	}
+
+	f, g := a.float(), b.float()
+
+	switch op {
+	case sql.PLUS:
+		return reflect.ValueOf(f + g)
+	case sql.MINUS:
+		return reflect.ValueOf(f - g)
+	case sql.STAR:
+		return reflect.ValueOf(f * g)
+	case sql.SLASH:
+		if g == 0 {
+			return null
+		}
+		return reflect.ValueOf(f / g)
+	case sql.REM:
+		// SQLite computes the remainder of the integer parts
+		if int64(g) == 0 {
+			return null
+		}
+		return reflect.ValueOf(float64(int64(f) % int64(g)))
+	}
+
+	raise("unsupported operator: %s", op)
+	return reflect.Value{}
+}
+
+// shiftLeft shifts i left by n bits, or right if n is negative. As in
+// SQLite, shifts of 64 or more bits produce 0 (or -1 for a negative value
+// shifted right).
+func shiftLeft(i, n int64) int64 {
+	switch {
+	case n >= 64:
+		return 0
+	case n >= 0:
+		return i << uint(n)
+	case n <= -64:
+		if i < 0 {
+			return -1
+		}
+		return 0
+	default:
+		return i >> uint(-n)
+	}
+}
+
+// evaluateUnary applies a unary operator to x
+func evaluateUnary(op sql.Token, x reflect.Value) reflect.Value {
+	if !x.IsValid() {
+		return null
+	}
+
+	switch op {
+	case sql.NOT:
+		return reflect.ValueOf(!isTrue(x))
+	case sql.PLUS:
+		return x
+	}
+
+	n := toNumeric(x)
+
+	switch op {
+	case sql.MINUS:
+		if !n.isInt {
+			return reflect.ValueOf(-n.f)
+		}
+		if n.i == math.MinInt64 {
+			return reflect.ValueOf(-float64(n.i))
+		}
+		return reflect.ValueOf(-n.i)
+	case sql.BITNOT:
+		if !n.isInt {
+			return reflect.ValueOf(^int64(n.f))
+		}
+		return reflect.ValueOf(^n.i)
+	}
+
+	raise("unsupported operator: %s", op)
+	return reflect.Value{}
+}
+
+// liftNot corrects the precedence of NOT, which the parser binds directly
+// to the operand that follows it. In SQLite, NOT binds more loosely than
+// comparison and arithmetic, so "NOT a = 1" means "NOT (a = 1)" rather than
+// "(NOT a) = 1", and "NOT a IS NULL" means "NOT (a IS NULL)". It rewrites
+// the tree bottom-up when used as a sql.VisitEndFunc.
+func liftNot(n sql.Node) (sql.Node, error) {
+	if null, ok := n.(*sql.Null); ok {
+		u, ok := null.X.(*sql.UnaryExpr)
+		if !ok || u.Op != sql.NOT {
+			return n, nil
+		}
+
+		null.X = u.X
+		u.X = null
+
+		return u, nil
+	}
+
+	b, ok := n.(*sql.BinaryExpr)
+	if !ok || b.Op == sql.AND || b.Op == sql.OR {
+		return n, nil
+	}
+
+	u, ok := b.X.(*sql.UnaryExpr)
+	if !ok || u.Op != sql.NOT {
+		return n, nil
+	}
+
+	b.X = u.X
+	u.X = b
+
+	return u, nil
+}
+
+// reassociate corrects the precedence of IS NOT and the other negated
+// operators the parser reads as a single token, such as NOT LIKE. The
+// parser reads the right operand of each as the rest of the expression, so
+// that "a IS NOT b AND c" is parsed as "a IS NOT (b AND c)", where in
+// SQLite they bind as tightly as "=". Any operator in a right operand which
+// binds no more tightly than the operator it belongs to is moved above it.
+// It rewrites the tree bottom-up when used as a sql.VisitEndFunc.
+func reassociate(n sql.Node) (sql.Node, error) {
+	b, ok := n.(*sql.BinaryExpr)
+	if !ok {
+		return n, nil
+	}
+
+	return rotateOperand(b), nil
+}
+
+// rotateOperand returns the expression b should have been parsed as, given
+// the right operand the parser read for it
+func rotateOperand(b *sql.BinaryExpr) sql.Expr {
+	switch y := b.Y.(type) {
+	case *sql.BinaryExpr:
+		if precedence(y.Op) <= precedence(b.Op) {
+			b.Y = y.X
+			y.X = rotateOperand(b)
+			return y
+		}
+	case *sql.Null:
+		if sql.EQ.Precedence() <= precedence(b.Op) {
+			b.Y = y.X
+			y.X = rotateOperand(b)
+			return y
+		}
+	}
+
+	return b
+}
+
+// precedence returns the precedence of the binary operator op. The negated
+// operators bind as tightly as the operators they negate.
+func precedence(op sql.Token) int {
+	switch op {
+	case sql.ISNOT, sql.NOTIN, sql.NOTLIKE, sql.NOTGLOB, sql.NOTREGEXP, sql.NOTMATCH, sql.NOTBETWEEN:
+		return sql.EQ.Precedence()
+	}
+
+	return op.Precedence()
+}
+
+// typeAffinity returns the affinity SQLite gives to the declared type name,
+// one of INTEGER, TEXT, BLOB, REAL or NUMERIC
+func typeAffinity(name string) string {
+	name = strings.ToUpper(name)
+
+	switch {
+	case strings.Contains(name, "INT"):
+		return "INTEGER"
+	case strings.Contains(name, "CHAR"), strings.Contains(name, "CLOB"), strings.Contains(name, "TEXT"):
+		return "TEXT"
+	case name == "", strings.Contains(name, "BLOB"):
+		return "BLOB"
+	case strings.Contains(name, "REAL"), strings.Contains(name, "FLOA"), strings.Contains(name, "DOUB"):
+		return "REAL"
+	}
+
+	return "NUMERIC"
+}
+
+// parseIntegerPrefix parses the longest integer prefix of s, as SQLite does
+// when casting text to INTEGER. Values beyond the range of an int64 are
+// clamped to it.
+func parseIntegerPrefix(s string) int64 {
+	s = strings.TrimSpace(s)
+
+	end := 0
+	if end < len(s) && (s[end] == '+' || s[end] == '-') {
+		end++
+	}
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+
+	i, err := strconv.ParseInt(s[:end], 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		if s[0] == '-' {
+			return math.MinInt64
+		}
+		return math.MaxInt64
+	}
+
+	return i
+}
+
+// truncateFloat converts f to an integer by discarding its fractional part,
+// clamping values beyond the range of an int64
+func truncateFloat(f float64) int64 {
+	switch {
+	case math.IsNaN(f):
+		return 0
+	case f >= math.MaxInt64:
+		return math.MaxInt64
+	case f <= math.MinInt64:
+		return math.MinInt64
+	}
+
+	return int64(f)
+}
+
+// evaluateCast converts x to the named type following SQLite's CAST rules,
+// which depend only on the affinity of the type. Blobs are represented as
+// text.
+func evaluateCast(x reflect.Value, typeName string) reflect.Value {
+	if !x.IsValid() {
+		return null
+	}
+
+	switch typeAffinity(typeName) {
+	case "TEXT", "BLOB":
+		return reflect.ValueOf(coerceToString(x))
+	case "REAL":
+		return reflect.ValueOf(toNumeric(x).float())
+	case "INTEGER":
+		if x.Kind() == reflect.String {
+			return reflect.ValueOf(parseIntegerPrefix(x.String()))
+		}
+
+		n := toNumeric(x)
+		if !n.isInt {
+			return reflect.ValueOf(truncateFloat(n.f))
+		}
+		return reflect.ValueOf(n.i)
+	}
+
+	// NUMERIC converts text to an integer where that is lossless, leaving
+	// any other value as it is
+	if x.Kind() != reflect.String {
+		return toNumeric(x).value()
+	}
+
+	n := parseNumeric(x.String())
+	if !n.isInt && n.f == math.Trunc(n.f) && n.f >= math.MinInt64 && n.f < math.MaxInt64 {
+		return reflect.ValueOf(int64(n.f))
+	}
+
+	return n.value()
+}
@@ -0,0 +1,139 @@
+package duckql
+
+import (
+	gosql "database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/rqlite/sql"
+)
+
+// parameter is a parameter of a statement, written as name at offset
+type parameter struct {
+	offset int
+	name   string
+	number int
+}
+
+// parameters returns the parameters of statement in the order in which
+// they appear, along with the largest number given to any of them.
+//
+// As in SQLite, "?NNN" is the NNNth parameter, and "?" or a parameter named
+// by ":name", "@name" or "$name" which has not appeared before is numbered
+// one past the largest number so far.
+func parameters(statement string) ([]parameter, int, error) {
+	var params []parameter
+	numbers := make(map[string]int)
+	count := 0
+
+	for _, token := range scanStatement(statement) {
+		if token.tok != sql.BIND {
+			continue
+		}
+
+		name := token.lit
+		number, ok := numbers[name]
+		switch {
+		case ok:
+		case name == "?":
+			number = count + 1
+		case name[0] == '?':
+			n, err := strconv.Atoi(name[1:])
+			if err != nil || n < 1 {
+				return nil, 0, errors.New("duckql: invalid parameter " + name)
+			}
+			number = n
+		default:
+			number = count + 1
+			numbers[name] = number
+		}
+		count = max(count, number)
+
+		params = append(params, parameter{offset: token.start, name: name, number: number})
+	}
+
+	return params, count, nil
+}
+
+// bindParameters finds the value of each of params among args, returning
+// the values by the offset at which each parameter appears. An argument
+// given as a database/sql.NamedArg is bound to the parameters of that name,
+// whatever their prefix, and any other argument to the parameter of its
+// position. count is the largest number of any parameter.
+func bindParameters(params []parameter, count int, args []any) (map[int]reflect.Value, error) {
+	var positional []any
+	named := make(map[string]any)
+	for _, arg := range args {
+		if n, ok := arg.(gosql.NamedArg); ok {
+			named[n.Name] = n.Value
+			continue
+		}
+
+		positional = append(positional, arg)
+	}
+
+	if len(positional) > count {
+		return nil, fmt.Errorf("duckql: expected %d arguments, got %d", count, len(positional))
+	}
+
+	values := make(map[int]reflect.Value, len(params))
+	for _, param := range params {
+		arg, ok := named[param.name[1:]]
+		if !ok || param.name[0] == '?' {
+			if param.number > len(positional) {
+				name := param.name
+				if name == "?" {
+					name += strconv.Itoa(param.number)
+				}
+				return nil, errors.New("duckql: missing value for parameter " + name)
+			}
+			arg = positional[param.number-1]
+		}
+
+		v, err := parameterValue(arg)
+		if err != nil {
+			return nil, err
+		}
+		values[param.offset] = v
+	}
+
+	return values, nil
+}
+
+// parameterValue returns the value of a parameter given arg, which is NULL
+// for nil. Pointers are followed, and a driver.Valuer gives its value.
+func parameterValue(arg any) (reflect.Value, error) {
+	if valuer, ok := arg.(driver.Valuer); ok {
+		value, err := valuer.Value()
+		if err != nil {
+			return null, err
+		}
+		arg = value
+	}
+
+	v := reflect.ValueOf(arg)
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return null, nil
+		}
+		v = v.Elem()
+	}
+
+	return v, nil
+}
+
+// parameter returns the value bound to the parameter t of the statement
+// for the execution
+func (e *execution) parameter(t *sql.BindExpr) reflect.Value {
+	if e != nil {
+		if v, ok := e.bindings[t.NamePos.Offset]; ok {
+			return v
+		}
+	}
+
+	raise("missing value for parameter %s", t.Name)
+	return null
+}
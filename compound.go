@@ -0,0 +1,246 @@
+package duckql
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rqlite/sql"
+)
+
+// compoundPart is a single SELECT of a compound statement, along with the
+// operator which combines it with the parts before it
+type compoundPart struct {
+	op   sql.Token
+	all  bool
+	stmt *sql.SelectStatement
+}
+
+// compoundParts splits a compound statement into its parts, in the order
+// they were written. The parser nests each part after the first in the one
+// before it, and gives the WITH, ORDER BY and LIMIT clauses of the whole
+// statement to the first part, so these are removed from it.
+func compoundParts(s *sql.SelectStatement) []compoundPart {
+	var parts []compoundPart
+
+	op, all := sql.ILLEGAL, false
+	for s != nil {
+		part := *s
+		part.Compound = nil
+
+		if len(parts) == 0 {
+			part.WithClause = nil
+			part.OrderingTerms = nil
+			part.Limit, part.LimitExpr = sql.Pos{}, nil
+			part.Offset, part.OffsetComma, part.OffsetExpr = sql.Pos{}, sql.Pos{}, nil
+		}
+
+		parts = append(parts, compoundPart{op: op, all: all, stmt: &part})
+
+		switch {
+		case s.Union.IsValid():
+			op, all = sql.UNION, s.UnionAll.IsValid()
+		case s.Intersect.IsValid():
+			op, all = sql.INTERSECT, false
+		case s.Except.IsValid():
+			op, all = sql.EXCEPT, false
+		}
+
+		s = s.Compound
+	}
+
+	return parts
+}
+
+// String returns the operator which combines the part with the parts
+// before it
+func (p compoundPart) String() string {
+	if p.all {
+		return p.op.String() + " ALL"
+	}
+
+	return p.op.String()
+}
+
+// prepareCompound prepares each part of a compound statement
+func (q *QueryExecutor) prepareCompound(t *sql.SelectStatement) error {
+	q.compound = compoundParts(t)
+
+	for _, part := range q.compound {
+		exec := q.child(nil)
+		if err := exec.prepare(part.stmt); err != nil {
+			return err
+		}
+
+		q.parts = append(q.parts, exec)
+	}
+
+	return nil
+}
+
+// combine executes the parts of a compound statement, combining their
+// results from left to right. The columns are named as those of the first
+// part are. Except for UNION ALL, the operators produce distinct rows in
+// the order SQLite does, which is sorted.
+func (q *QueryExecutor) combine() *IntermediateTable {
+	columns := q.parts[0].columnNames()
+
+	var rows ResultRows
+	for idx, part := range q.compound {
+		exec := q.parts[idx]
+
+		r := exec.rows()
+		if len(exec.columnNames()) != len(columns) {
+			raise("SELECTs to the left and right of %s do not have the same number of result columns", part)
+		}
+
+		if idx > 0 {
+			r = renameRows(r, columns)
+		}
+
+		switch {
+		case idx == 0 || (part.op == sql.UNION && part.all):
+			rows = append(rows, r...)
+			continue
+		case part.op == sql.UNION:
+			// Of rows which are equal, the last is kept
+			slices.Reverse(rows)
+			slices.Reverse(r)
+			rows = distinctRows(append(r, rows...))
+		case part.op == sql.INTERSECT:
+			rows = matchingRows(distinctRows(rows), r, true)
+		case part.op == sql.EXCEPT:
+			rows = matchingRows(distinctRows(rows), r, false)
+		}
+
+		slices.SortStableFunc(rows, compareRows)
+	}
+
+	table := NewIntermediateTable()
+	table.Source = &Table{Columns: columns}
+	table.Columns = columns
+	table.Rows = rows
+	table.sqlizer = q.s
+	table.now = q.now
+	table.exec = q
+
+	return table
+}
+
+// compoundOrder resolves the ORDER BY terms of a compound statement, each
+// of which must name or number a column of the result
+func (q *QueryExecutor) compoundOrder(table *IntermediateTable) []orderKey {
+	var keys []orderKey
+
+	for idx, term := range q.order {
+		column := -1
+		switch t := term.X.(type) {
+		case *sql.Ident:
+			column = slices.Index(table.Columns, t.Name)
+		case *sql.QualifiedRef:
+			if t.Column != nil {
+				column = slices.Index(table.Columns, t.Column.Name)
+			}
+		default:
+			if n, ok := orderOrdinal(t); ok && n > 0 && n <= int64(len(table.Columns)) {
+				column = int(n - 1)
+			}
+		}
+
+		if column < 0 {
+			raise("%s ORDER BY term does not match any column in the result set", ordinal(idx+1))
+		}
+
+		keys = append(keys, orderKey{column: column})
+	}
+
+	return keys
+}
+
+// ordinal returns n followed by its English ordinal suffix, as in "2nd"
+func ordinal(n int) string {
+	suffix := "th"
+	switch {
+	case n%100 >= 11 && n%100 <= 13:
+	case n%10 == 1:
+		suffix = "st"
+	case n%10 == 2:
+		suffix = "nd"
+	case n%10 == 3:
+		suffix = "rd"
+	}
+
+	return strconv.Itoa(n) + suffix
+}
+
+// rowKey returns a string which is equal for any two rows whose values SQLite
+// would consider equal
+func rowKey(row ResultRow) string {
+	var key strings.Builder
+	for _, value := range row {
+		key.WriteString(valueKey(value.Value))
+		key.WriteByte(0)
+	}
+
+	return key.String()
+}
+
+// distinctRows returns the first of each set of equal rows
+func distinctRows(rows ResultRows) ResultRows {
+	var result ResultRows
+
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		key := rowKey(row)
+		if seen[key] {
+			continue
+		}
+
+		seen[key] = true
+		result = append(result, row)
+	}
+
+	return result
+}
+
+// matchingRows returns the rows which are equal to some row of other, or
+// which are not if match is false
+func matchingRows(rows ResultRows, other ResultRows, match bool) ResultRows {
+	keys := make(map[string]bool)
+	for _, row := range other {
+		keys[rowKey(row)] = true
+	}
+
+	var result ResultRows
+	for _, row := range rows {
+		if keys[rowKey(row)] == match {
+			result = append(result, row)
+		}
+	}
+
+	return result
+}
+
+// renameRows returns rows with their values named by columns
+func renameRows(rows ResultRows, columns []string) ResultRows {
+	result := make(ResultRows, len(rows))
+	for idx, row := range rows {
+		result[idx] = make(ResultRow, len(row))
+		for i, value := range row {
+			result[idx][i] = ResultValue{Name: columns[i], Value: value.Value}
+		}
+	}
+
+	return result
+}
+
+// compareRows orders two rows by their values, from first to last
+func compareRows(a, b ResultRow) int {
+	for idx := range a {
+		if c := compareValues(a[idx].Value, b[idx].Value); c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,222 @@
+package duckql
+
+import (
+	"slices"
+
+	"github.com/rqlite/sql"
+)
+
+// commonTable is a common table expression defined by the WITH clause of a
+// statement, which is evaluated the first time it is read
+type commonTable struct {
+	cte       *sql.CTE
+	recursive bool
+
+	// exec is the executor of the statement defining the expression
+	exec  *QueryExecutor
+	table *IntermediateTable
+
+	// evaluating is set while the expression is evaluated, and working
+	// holds the row which the recursive part of a recursive expression
+	// reads in place of the whole table
+	evaluating bool
+	working    *IntermediateTable
+}
+
+// defineCommonTables records the common table expressions of a WITH
+// clause, which may then be read by the statement and its subqueries
+func (q *QueryExecutor) defineCommonTables(with *sql.WithClause) {
+	q.ctes = nil
+	if with == nil {
+		return
+	}
+
+	q.ctes = make(map[string]*commonTable)
+	for _, cte := range with.CTEs {
+		name := cte.TableName.Name
+		q.ctes[name] = &commonTable{
+			cte:       cte,
+			recursive: with.Recursive.IsValid() && referencesTable(cte.Select, name),
+			exec:      q,
+		}
+	}
+}
+
+// commonTable returns the common table expression named name which is in
+// scope for the statement, or nil if there is none
+func (q *QueryExecutor) commonTable(name string) *commonTable {
+	for ; q != nil; q = q.parent {
+		if c, ok := q.ctes[name]; ok {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// referencesTable reports whether any part of a compound SELECT reads from
+// the table named name
+func referencesTable(s *sql.SelectStatement, name string) bool {
+	found := false
+	_, _ = sql.Walk(sql.VisitFunc(func(n sql.Node) (sql.Node, error) {
+		if t, ok := n.(*sql.QualifiedTableName); ok && t.Name.Name == name {
+			found = true
+		}
+		return n, nil
+	}), s)
+
+	return found
+}
+
+// read returns a copy of the table produced by the expression, evaluating
+// it if this is the first time it is read
+func (c *commonTable) read() *IntermediateTable {
+	table := c.working
+	if table == nil {
+		if c.table == nil {
+			if c.evaluating {
+				raise("circular reference: %s", c.cte.TableName.Name)
+			}
+
+			c.evaluating = true
+			if c.recursive {
+				c.table = c.evaluateRecursive()
+			} else {
+				c.table = c.evaluate(c.exec, c.cte.Select)
+			}
+			c.evaluating = false
+		}
+
+		table = c.table
+	}
+
+	result := NewIntermediateTable()
+	result.Source = table.Source
+	result.Columns = table.Columns
+	result.Rows = slices.Clone(table.Rows)
+
+	return result
+}
+
+// evaluate executes s as a subquery of the statement exec, returning its
+// result as a table with the columns of the expression
+func (c *commonTable) evaluate(exec *QueryExecutor, s *sql.SelectStatement) *IntermediateTable {
+	sub := exec.child(nil)
+	if err := sub.prepare(s); err != nil {
+		panic(evaluationError{err})
+	}
+
+	table := sub.table(c.cte.TableName.Name)
+
+	if len(c.cte.Columns) > 0 {
+		if len(c.cte.Columns) != len(table.Columns) {
+			raise("table %s has %d values for %d columns", c.cte.TableName.Name, len(table.Columns), len(c.cte.Columns))
+		}
+
+		var columns []string
+		for _, column := range c.cte.Columns {
+			columns = append(columns, column.Name)
+		}
+
+		table.Source = &Table{Name: c.cte.TableName.Name, Columns: columns}
+		table.Columns = columns
+	}
+
+	return table
+}
+
+// evaluateRecursive evaluates a recursive expression as SQLite does. The
+// rows of the parts which do not refer to the expression are placed in a
+// queue, and each row taken from the queue is added to the result and
+// given to the recursive parts as the content of the table, adding the rows
+// they produce to the queue. With UNION, unlike UNION ALL, rows which have
+// already been queued are discarded. LIMIT stops the recursion once the
+// result has that many rows after those skipped by OFFSET.
+func (c *commonTable) evaluateRecursive() *IntermediateTable {
+	name := c.cte.TableName.Name
+
+	if len(c.cte.Select.OrderingTerms) > 0 {
+		raise("ORDER BY is not supported in recursive common table expression %s", name)
+	}
+
+	// The rows skipped by OFFSET do not count towards the LIMIT
+	limit, offset := int64(-1), int64(0)
+	if expr, offsetExpr := limitClause(c.cte.Select); expr != nil {
+		limit = c.exec.limitValue(expr)
+		if offsetExpr != nil {
+			offset = max(c.exec.limitValue(offsetExpr), 0)
+		}
+	}
+
+	parts := compoundParts(c.cte.Select)
+
+	// The parts share any WITH clause of the expression's statement
+	scope := c.exec.child(nil)
+	scope.defineCommonTables(c.cte.Select.WithClause)
+
+	recursive := slices.IndexFunc(parts, func(part compoundPart) bool {
+		return referencesTable(part.stmt, name)
+	})
+	if recursive < 1 {
+		raise("circular reference: %s", name)
+	}
+
+	for _, part := range parts[1:] {
+		if part.op != sql.UNION {
+			raise("recursive common table expression %s may only use UNION or UNION ALL", name)
+		}
+	}
+
+	// The operator joining the recursive parts to the rest decides whether
+	// every row added to the queue must be distinct
+	distinct := !parts[recursive].all
+
+	var table *IntermediateTable
+	var queue ResultRows
+	seen := make(map[string]bool)
+
+	add := func(rows ResultRows) {
+		if len(rows) > 0 && len(rows[0]) != len(table.Columns) {
+			raise("SELECTs to the left and right of UNION do not have the same number of result columns")
+		}
+
+		for _, row := range rows {
+			key := rowKey(row)
+			if distinct && seen[key] {
+				continue
+			}
+
+			seen[key] = true
+			queue = append(queue, row)
+		}
+	}
+
+	for _, part := range parts[:recursive] {
+		anchor := c.evaluate(scope, part.stmt)
+		if table == nil {
+			table = &IntermediateTable{Source: anchor.Source, Columns: anchor.Columns}
+		}
+
+		add(anchor.Rows)
+	}
+
+	for len(queue) > 0 && (limit < 0 || int64(len(table.Rows)) < offset+limit) {
+		// A recursive expression which never stops adding rows is ended
+		// by cancelling the statement
+		c.exec.e.checkContext()
+
+		row := queue[0]
+		queue = queue[1:]
+		table.Rows = append(table.Rows, row)
+
+		c.working = &IntermediateTable{Source: table.Source, Columns: table.Columns, Rows: ResultRows{row}}
+		for _, part := range parts[recursive:] {
+			add(c.evaluate(scope, part.stmt).Rows)
+		}
+	}
+	c.working = nil
+
+	table.Rows = table.Rows[min(offset, int64(len(table.Rows))):]
+
+	return table
+}
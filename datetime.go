@@ -0,0 +1,467 @@
+package duckql
+
+import (
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateTimeFunction is an entry in the registry of date and time functions.
+// These are kept apart from the other scalar functions because they need the
+// time at which the statement began, which is what 'now' refers to.
+type dateTimeFunction struct {
+	minArgs  int
+	maxArgs  int
+	function func(now time.Time, args []reflect.Value) reflect.Value
+}
+
+var dateTimeFunctionMap = map[string]dateTimeFunction{
+	"date":      {0, -1, dateFunction},
+	"datetime":  {0, -1, datetimeFunction},
+	"julianday": {0, -1, juliandayFunction},
+	"strftime":  {1, -1, strftimeFunction},
+	"time":      {0, -1, timeFunction},
+	"unixepoch": {0, -1, unixepochFunction},
+}
+
+// dateTime is the result of evaluating a time value and its modifiers. All
+// times are in UTC, as in SQLite.
+type dateTime struct {
+	t      time.Time
+	subsec bool
+}
+
+// unixEpochJulianDay is the Julian day number of 1970-01-01 00:00:00 UTC
+const unixEpochJulianDay = 2440587.5
+
+func fromUnix(f float64) time.Time {
+	return time.UnixMilli(int64(math.Round(f * 1000))).UTC()
+}
+
+func fromJulianDay(jd float64) time.Time {
+	return time.UnixMilli(int64(math.Round((jd - unixEpochJulianDay) * 86400000))).UTC()
+}
+
+func toJulianDay(t time.Time) float64 {
+	return float64(t.UnixMilli())/86400000 + unixEpochJulianDay
+}
+
+var (
+	dateTimePattern = regexp.MustCompile(`^(\d{4})-(\d{2})-(\d{2})(?:[T ](\d{2}):(\d{2})(?::(\d{2})(\.\d+)?)?)?\s*(Z|[+-]\d{2}:\d{2})?$`)
+	timePattern     = regexp.MustCompile(`^(\d{2}):(\d{2})(?::(\d{2})(\.\d+)?)?\s*(Z|[+-]\d{2}:\d{2})?$`)
+)
+
+// parseTimeString parses a time value written in one of the formats SQLite
+// accepts: "YYYY-MM-DD", optionally followed by a time and a timezone, a
+// time alone (which falls on 2000-01-01), or 'now'. A zero now means that
+// 'now' is not accepted.
+func parseTimeString(s string, now time.Time) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+
+	if strings.EqualFold(s, "now") {
+		return now.UTC(), !now.IsZero()
+	}
+
+	var year, month, day, hour, minute, second, fraction, zone string
+	if m := dateTimePattern.FindStringSubmatch(s); m != nil {
+		year, month, day, hour, minute, second, fraction, zone = m[1], m[2], m[3], m[4], m[5], m[6], m[7], m[8]
+	} else if m := timePattern.FindStringSubmatch(s); m != nil {
+		year, month, day, hour, minute, second, fraction, zone = "2000", "01", "01", m[1], m[2], m[3], m[4], m[5]
+	} else {
+		return time.Time{}, false
+	}
+
+	atoi := func(s string) int {
+		i, _ := strconv.Atoi(s)
+		return i
+	}
+
+	var nsec int
+	if fraction != "" {
+		f, _ := strconv.ParseFloat(fraction, 64)
+		nsec = int(math.Round(f*1000)) * int(time.Millisecond)
+	}
+
+	if atoi(month) < 1 || atoi(month) > 12 || atoi(day) < 1 || atoi(day) > 31 ||
+		atoi(hour) > 24 || atoi(minute) > 59 || atoi(second) > 59 {
+		return time.Time{}, false
+	}
+
+	t := time.Date(atoi(year), time.Month(atoi(month)), atoi(day), atoi(hour), atoi(minute), atoi(second), nsec, time.UTC)
+
+	if zone != "" && zone != "Z" {
+		offset := time.Duration(atoi(zone[1:3]))*time.Hour + time.Duration(atoi(zone[4:6]))*time.Minute
+		if zone[0] == '+' {
+			offset = -offset
+		}
+		t = t.Add(offset)
+	}
+
+	return t, true
+}
+
+// asNumber returns the value of x if it is a number, or text which consists
+// entirely of a number
+func asNumber(x reflect.Value) (float64, bool) {
+	if x.Kind() == reflect.String {
+		f, err := strconv.ParseFloat(strings.TrimSpace(x.String()), 64)
+		return f, err == nil
+	}
+
+	if x.Kind() == reflect.Bool || (x.Kind() == reflect.Struct && x.Type() == reflect.TypeOf(time.Time{})) {
+		return 0, false
+	}
+
+	if f := coerceToFloat(x); f != nil {
+		return *f, true
+	}
+
+	return 0, false
+}
+
+// evaluateTimeValue computes the time described by a time value followed by
+// any number of modifiers, as taken by each of the date and time functions.
+// With no arguments, the result is the current time.
+func evaluateTimeValue(now time.Time, args []reflect.Value) (dateTime, bool) {
+	if len(args) == 0 {
+		return dateTime{t: now.UTC()}, true
+	}
+
+	if anyNull(args) {
+		return dateTime{}, false
+	}
+
+	var modifiers []string
+	for _, arg := range args[1:] {
+		modifiers = append(modifiers, strings.ToLower(strings.TrimSpace(coerceToString(arg))))
+	}
+
+	var dt dateTime
+
+	x := args[0]
+	if t, ok := x.Interface().(time.Time); ok {
+		dt.t = t.UTC()
+	} else if f, ok := asNumber(x); ok {
+		// Numbers are Julian day numbers unless the first modifier says
+		// otherwise
+		unit := "julianday"
+		if len(modifiers) > 0 {
+			switch modifiers[0] {
+			case "unixepoch", "julianday", "auto":
+				unit = modifiers[0]
+				modifiers = modifiers[1:]
+			}
+		}
+
+		if unit == "auto" {
+			unit = "unixepoch"
+			if f >= 0 && f < 5373484.5 {
+				unit = "julianday"
+			}
+		}
+
+		if unit == "unixepoch" {
+			dt.t = fromUnix(f)
+		} else {
+			dt.t = fromJulianDay(f)
+		}
+	} else if t, ok := parseTimeString(coerceToString(x), now); ok {
+		dt.t = t
+	} else {
+		return dateTime{}, false
+	}
+
+	for _, modifier := range modifiers {
+		if !dt.apply(modifier) {
+			return dateTime{}, false
+		}
+	}
+
+	if dt.t.Year() < 0 || dt.t.Year() > 9999 {
+		return dateTime{}, false
+	}
+
+	return dt, true
+}
+
+var (
+	unitModifierPattern  = regexp.MustCompile(`^([+-]?(?:\d+(?:\.\d*)?|\.\d+))\s*(day|hour|minute|second|month|year)s?$`)
+	shiftModifierPattern = regexp.MustCompile(`^([+-])(?:(\d{4})-(\d{2})-(\d{2})\s*)?(?:(\d{2}):(\d{2})(?::(\d{2})(\.\d+)?)?)?$`)
+	weekdayPattern       = regexp.MustCompile(`^weekday\s+([0-6])$`)
+)
+
+// apply applies a single modifier to dt, reporting whether the modifier was
+// understood
+func (dt *dateTime) apply(modifier string) bool {
+	t := dt.t
+
+	switch modifier {
+	case "start of day":
+		dt.t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return true
+	case "start of month":
+		dt.t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return true
+	case "start of year":
+		dt.t = time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+		return true
+	case "localtime":
+		local := t.In(time.Local)
+		dt.t = time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), local.Nanosecond(), time.UTC)
+		return true
+	case "utc":
+		dt.t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.Local).UTC()
+		return true
+	case "subsec", "subsecond":
+		dt.subsec = true
+		return true
+	}
+
+	if m := weekdayPattern.FindStringSubmatch(modifier); m != nil {
+		weekday, _ := strconv.Atoi(m[1])
+		dt.t = t.AddDate(0, 0, (weekday-int(t.Weekday())+7)%7)
+		return true
+	}
+
+	if m := unitModifierPattern.FindStringSubmatch(modifier); m != nil {
+		n, _ := strconv.ParseFloat(m[1], 64)
+
+		switch m[2] {
+		case "day":
+			dt.t = t.Add(time.Duration(math.Round(n*86400000)) * time.Millisecond)
+		case "hour":
+			dt.t = t.Add(time.Duration(math.Round(n*3600000)) * time.Millisecond)
+		case "minute":
+			dt.t = t.Add(time.Duration(math.Round(n*60000)) * time.Millisecond)
+		case "second":
+			dt.t = t.Add(time.Duration(math.Round(n*1000)) * time.Millisecond)
+		case "month":
+			// Whole months are added to the month number, and any fraction
+			// is added as a number of 30 day months
+			whole := math.Trunc(n)
+			dt.t = t.AddDate(0, int(whole), 0).Add(time.Duration(math.Round((n-whole)*30*86400000)) * time.Millisecond)
+		case "year":
+			whole := math.Trunc(n)
+			dt.t = t.AddDate(int(whole), 0, 0).Add(time.Duration(math.Round((n-whole)*365*86400000)) * time.Millisecond)
+		}
+		return true
+	}
+
+	if m := shiftModifierPattern.FindStringSubmatch(modifier); m != nil && (m[2] != "" || m[5] != "") {
+		sign := 1
+		if m[1] == "-" {
+			sign = -1
+		}
+
+		atoi := func(s string) int {
+			i, _ := strconv.Atoi(s)
+			return i
+		}
+
+		t = t.AddDate(sign*atoi(m[2]), sign*atoi(m[3]), sign*atoi(m[4]))
+
+		shift := time.Duration(atoi(m[5]))*time.Hour + time.Duration(atoi(m[6]))*time.Minute + time.Duration(atoi(m[7]))*time.Second
+		if m[8] != "" {
+			f, _ := strconv.ParseFloat(m[8], 64)
+			shift += time.Duration(math.Round(f*1000)) * time.Millisecond
+		}
+
+		dt.t = t.Add(time.Duration(sign) * shift)
+		return true
+	}
+
+	return false
+}
+
+func dateFunction(now time.Time, args []reflect.Value) reflect.Value {
+	dt, ok := evaluateTimeValue(now, args)
+	if !ok {
+		return null
+	}
+
+	return reflect.ValueOf(formatYear(dt.t) + dt.t.Format("-01-02"))
+}
+
+func timeFunction(now time.Time, args []reflect.Value) reflect.Value {
+	dt, ok := evaluateTimeValue(now, args)
+	if !ok {
+		return null
+	}
+
+	if dt.subsec {
+		return reflect.ValueOf(dt.t.Format("15:04:05.000"))
+	}
+
+	return reflect.ValueOf(dt.t.Format("15:04:05"))
+}
+
+func datetimeFunction(now time.Time, args []reflect.Value) reflect.Value {
+	dt, ok := evaluateTimeValue(now, args)
+	if !ok {
+		return null
+	}
+
+	if dt.subsec {
+		return reflect.ValueOf(formatYear(dt.t) + dt.t.Format("-01-02 15:04:05.000"))
+	}
+
+	return reflect.ValueOf(formatYear(dt.t) + dt.t.Format("-01-02 15:04:05"))
+}
+
+func juliandayFunction(now time.Time, args []reflect.Value) reflect.Value {
+	dt, ok := evaluateTimeValue(now, args)
+	if !ok {
+		return null
+	}
+
+	return reflect.ValueOf(toJulianDay(dt.t))
+}
+
+func unixepochFunction(now time.Time, args []reflect.Value) reflect.Value {
+	dt, ok := evaluateTimeValue(now, args)
+	if !ok {
+		return null
+	}
+
+	if dt.subsec {
+		return reflect.ValueOf(float64(dt.t.UnixMilli()) / 1000)
+	}
+
+	return reflect.ValueOf(dt.t.Unix())
+}
+
+// formatYear formats the year of t with four digits, as Go only pads years
+// from 1000 onwards
+func formatYear(t time.Time) string {
+	return leftPad(strconv.Itoa(t.Year()), '0', 4)
+}
+
+func leftPad(s string, pad byte, width int) string {
+	for len(s) < width {
+		s = string(pad) + s
+	}
+	return s
+}
+
+// strftimeFunction implements strftime(format, time-value, modifiers...),
+// formatting the time with the substitutions supported by SQLite
+func strftimeFunction(now time.Time, args []reflect.Value) reflect.Value {
+	if !args[0].IsValid() {
+		return null
+	}
+
+	format := coerceToString(args[0])
+
+	dt, ok := evaluateTimeValue(now, args[1:])
+	if !ok {
+		return null
+	}
+	t := dt.t
+
+	number := func(n, width int) string {
+		return leftPad(strconv.Itoa(n), '0', width)
+	}
+
+	hour12 := t.Hour() % 12
+	if hour12 == 0 {
+		hour12 = 12
+	}
+
+	isoYear, isoWeek := t.ISOWeek()
+
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+
+		i++
+		if i >= len(format) {
+			return null
+		}
+
+		switch format[i] {
+		case 'd':
+			b.WriteString(number(t.Day(), 2))
+		case 'e':
+			b.WriteString(leftPad(strconv.Itoa(t.Day()), ' ', 2))
+		case 'f':
+			b.WriteString(t.Format("05.000"))
+		case 'F':
+			b.WriteString(formatYear(t) + t.Format("-01-02"))
+		case 'G':
+			b.WriteString(number(isoYear, 4))
+		case 'g':
+			b.WriteString(number(isoYear%100, 2))
+		case 'H':
+			b.WriteString(number(t.Hour(), 2))
+		case 'I':
+			b.WriteString(number(hour12, 2))
+		case 'j':
+			b.WriteString(number(t.YearDay(), 3))
+		case 'J':
+			b.WriteString(strconv.FormatFloat(toJulianDay(t), 'f', -1, 64))
+		case 'k':
+			b.WriteString(leftPad(strconv.Itoa(t.Hour()), ' ', 2))
+		case 'l':
+			b.WriteString(leftPad(strconv.Itoa(hour12), ' ', 2))
+		case 'm':
+			b.WriteString(number(int(t.Month()), 2))
+		case 'M':
+			b.WriteString(number(t.Minute(), 2))
+		case 'p':
+			b.WriteString(t.Format("PM"))
+		case 'P':
+			b.WriteString(t.Format("pm"))
+		case 'R':
+			b.WriteString(t.Format("15:04"))
+		case 's':
+			b.WriteString(strconv.FormatInt(t.Unix(), 10))
+		case 'S':
+			b.WriteString(number(t.Second(), 2))
+		case 'T':
+			b.WriteString(t.Format("15:04:05"))
+		case 'u':
+			b.WriteString(strconv.Itoa((int(t.Weekday())+6)%7 + 1))
+		case 'U':
+			b.WriteString(number((t.YearDay()+6-int(t.Weekday()))/7, 2))
+		case 'V':
+			b.WriteString(number(isoWeek, 2))
+		case 'w':
+			b.WriteString(strconv.Itoa(int(t.Weekday())))
+		case 'W':
+			b.WriteString(number((t.YearDay()+6-(int(t.Weekday())+6)%7)/7, 2))
+		case 'Y':
+			b.WriteString(formatYear(t))
+		case '%':
+			b.WriteByte('%')
+		default:
+			return null
+		}
+	}
+
+	return reflect.ValueOf(b.String())
+}
+
+// coerceTimeOperands allows a time.Time to be compared with text: if one of
+// x and y is a time.Time and the other is text holding a time value, the
+// text is converted into a time.Time
+func coerceTimeOperands(x, y reflect.Value) (reflect.Value, reflect.Value) {
+	timeType := reflect.TypeOf(time.Time{})
+
+	if x.Type() == timeType && y.Kind() == reflect.String {
+		if t, ok := parseTimeString(y.String(), time.Time{}); ok {
+			y = reflect.ValueOf(t)
+		}
+	} else if y.Type() == timeType && x.Kind() == reflect.String {
+		if t, ok := parseTimeString(x.String(), time.Time{}); ok {
+			x = reflect.ValueOf(t)
+		}
+	}
+
+	return x, y
+}
@@ -1,11 +1,14 @@
 package duckql
 
 import (
-	"cmp"
+	"errors"
+	"math"
 	"reflect"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/rqlite/sql"
 )
@@ -15,11 +18,43 @@ type QueryExecutor struct {
 
 	s             *SQLizer
 	intermediate  IntermediateVisitor
-	tables        map[string]*Table
+	distinct      bool
 	filter        sql.Node
+	groupBy       []sql.Expr
+	having        sql.Expr
 	limit         sql.Expr
+	offset        sql.Expr
 	order         []*sql.OrderingTerm
 	resultColumns []*sql.ResultColumn
+	windows       []*sql.Window
+
+	// now is the time at which the statement began, which its subqueries
+	// share
+	now time.Time
+
+	// e is the execution of the statement, which its subqueries share
+	e *execution
+
+	// parent is the executor of the statement enclosing a subquery, and
+	// outer is the row of that statement for which the subquery is run
+	parent *QueryExecutor
+	outer  *outerRow
+
+	// filled holds the tables read by a statement and its subqueries, so
+	// that each is read from the backing once, and results holds the
+	// results of subqueries which do not refer to an enclosing statement.
+	// Both belong to the executor of the outermost statement.
+	filled  map[*Table]*IntermediateTable
+	results map[*sql.SelectStatement]ResultRows
+
+	// ctes holds the common table expressions defined by the statement's
+	// WITH clause
+	ctes map[string]*commonTable
+
+	// compound holds the parts of a compound statement, each of which is
+	// executed by the executor at the same index of parts
+	compound []compoundPart
+	parts    []*QueryExecutor
 }
 
 func (q *QueryExecutor) Filter() sql.Node {
@@ -27,516 +62,597 @@ func (q *QueryExecutor) Filter() sql.Node {
 }
 
 func (q *QueryExecutor) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
-	if q.tables == nil {
-		q.tables = make(map[string]*Table)
-	}
-
 	switch t := n.(type) {
 	case *sql.SelectStatement:
-		if t.Limit.IsValid() {
-			q.limit = t.LimitExpr
-		}
-		if t.OrderingTerms != nil {
-			q.order = t.OrderingTerms
+		q.now = q.s.Now()
+		q.filled = make(map[*Table]*IntermediateTable)
+		q.results = make(map[*sql.SelectStatement]ResultRows)
+
+		if err := q.prepare(t); err != nil {
+			return nil, nil, err
 		}
 
-		q.filter = t.WhereExpr
+		// Subqueries are prepared as they are executed, so there is
+		// nothing left to visit
+		return nil, n, nil
+	}
 
-	case *sql.QualifiedTableName:
-		var qt QualifiedTableVisitor
-		qt.F = q
+	return q, n, nil
+}
+
+func (q *QueryExecutor) VisitEnd(n sql.Node) (sql.Node, error) {
+	return n, nil
+}
+
+// prepare records the clauses of a SELECT statement and reads the source
+// it selects from
+func (q *QueryExecutor) prepare(t *sql.SelectStatement) error {
+	q.limit, q.offset = limitClause(t)
+
+	q.distinct = t.Distinct.IsValid()
+	q.order = t.OrderingTerms
+	q.filter = t.WhereExpr
+	q.resultColumns = t.Columns
+	q.groupBy = t.GroupByExprs
+	q.having = t.HavingExpr
+	q.windows = t.Windows
+
+	q.defineCommonTables(t.WithClause)
 
-		q.intermediate = &qt
+	q.compound, q.parts = nil, nil
+	if t.Compound != nil {
+		return q.prepareCompound(t)
+	}
+
+	var err error
+	q.intermediate, err = q.source(t.Source)
+
+	return err
+}
 
-		return qt.Visit(n)
+// source returns a visitor which has read the rows of a FROM clause
+func (q *QueryExecutor) source(source sql.Source) (IntermediateVisitor, error) {
+	var v IntermediateVisitor
 
+	switch t := source.(type) {
+	case nil:
+		// A statement without a FROM clause selects from a single row
+		// with no columns
+		table := NewIntermediateTable()
+		table.Rows = ResultRows{ResultRow{}}
+
+		return &QualifiedTableVisitor{F: q, Table: table}, nil
+	case *sql.QualifiedTableName:
+		v = &QualifiedTableVisitor{F: q}
 	case *sql.JoinClause:
-		var jv JoinVisitor
-		jv.F = q
+		v = &JoinVisitor{F: q}
+	case *sql.ParenSource:
+		if _, ok := t.X.(*sql.SelectStatement); !ok {
+			return q.source(t.X)
+		}
 
-		q.intermediate = &jv
+		v = &SubqueryVisitor{F: q}
+	default:
+		return nil, errors.New("duckql: unsupported source: " + nodeString(source))
+	}
 
-		return jv.Visit(n)
+	if _, _, err := v.Visit(source); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
 
-	case *sql.ResultColumn:
-		q.resultColumns = append(q.resultColumns, t)
+// fill reads the rows of table from the backing. Each table is read once
+// per statement, however many times the statement and its subqueries refer
+// to it.
+func (q *QueryExecutor) fill(table *IntermediateTable) {
+	root := q.root()
 
+	if filled, ok := root.filled[table.Source]; ok {
+		table.Columns = filled.Columns
+		table.Rows = slices.Clone(filled.Rows)
+		return
 	}
 
-	return q, n, nil
+	// The backing finds the execution the table is read for, and so its
+	// context, through the table
+	table.exec = q
+	q.FillIntermediate(table)
+
+	// A backing which gives up reading the table when the statement is
+	// cancelled leaves it incomplete
+	q.e.checkContext()
+
+	if root.filled != nil {
+		root.filled[table.Source] = &IntermediateTable{Columns: table.Columns, Rows: slices.Clone(table.Rows)}
+	}
 }
 
-func (q *QueryExecutor) VisitEnd(n sql.Node) (sql.Node, error) {
-	return n, nil
+// run executes the statement n under the execution e
+func (q *QueryExecutor) run(n sql.Node, e *execution) (ResultRows, error) {
+	q.e = e
+
+	if _, err := sql.Walk(q, n); err != nil {
+		return nil, err
+	}
+
+	return q.RowsWithError()
 }
 
+// Rows returns the rows of the statement, or nil if it cannot be executed
 func (q *QueryExecutor) Rows() ResultRows {
+	r, _ := q.RowsWithError()
+	return r
+}
+
+// RowsWithError returns the rows of the statement, or the error which
+// prevented it from being executed
+func (q *QueryExecutor) RowsWithError() (r ResultRows, err error) {
+	defer recoverEvaluation(&err)
+
+	return q.rows(), nil
+}
+
+// rows executes the statement, raising any error encountered
+func (q *QueryExecutor) rows() ResultRows {
+	if len(q.parts) > 0 {
+		table := q.combine()
+		keys := q.compoundOrder(table)
+
+		values := make([][]reflect.Value, len(table.Rows))
+		for idx, row := range table.Rows {
+			values[idx] = orderValues(keys, sourceRow{}, row)
+		}
+
+		return q.applyLimit(sortRows(table.Rows, values, q.order))
+	}
+
 	var r ResultRows
 
 	source := q.intermediate.Result()
+	source.sqlizer = q.s
+	source.now = q.now
+	source.exec = q
 	source = source.Filter(q.filter)
 
-	if len(source.Rows) == 0 {
+	keys := q.orderKeys(source)
+
+	if len(source.Rows) == 0 && !q.isAggregate() {
 		return r
 	}
 
-	// Transform our intermediate columns into a lookup table
-	lookup := make(map[string]int)
-	for idx, column := range source.Columns {
-		lookup[column] = idx
+	// Each group of an aggregate query, or otherwise each row which
+	// satisfies the WHERE clause, produces a result row
+	var rows []sourceRow
+	if q.isAggregate() {
+		rows = q.groups(source)
+	} else {
+		for _, row := range source.Rows {
+			rows = append(rows, sourceRow{table: source, row: row})
+		}
 	}
 
-	// Order
-	if len(q.order) > 0 {
-		var expandedOrder []int
-		var asc []bool
-
-		for _, o := range q.order {
-			asc = append(asc, !o.Desc.IsValid())
+	// Window functions see every row, and may be sorted by
+	exprs := q.resultExprs()
+	for _, term := range q.order {
+		exprs = append(exprs, term.X)
+	}
+	q.window(rows, windowCalls(exprs...))
 
-			switch t := o.X.(type) {
-			case *sql.Ident:
-				i, ok := lookup[t.Name]
-				if !ok {
-					// FIXME: There should be a better way
-					parts := strings.Split(source.Columns[0], ".")
-					if len(parts) > 1 {
-						i = lookup[parts[0]+"."+t.Name]
-					}
-				}
-				expandedOrder = append(expandedOrder, i)
-			case *sql.QualifiedRef:
-				if t.Star.Line != 0 {
-					// FIXME: Implement
-					continue
-				}
+	values := make([][]reflect.Value, len(rows))
+	for idx, row := range rows {
+		q.e.checkContext()
 
-				lh := t.Table.Name
-				rh := t.Column.Name
-
-				var i int
-				var ok bool
-				if source.Source != nil {
-					i, ok = lookup[rh]
-				} else {
-					i, ok = lookup[lh+"."+rh]
-					if !ok {
-						i = lookup[source.Aliases[lh]+"."+rh]
-					}
-				}
-				expandedOrder = append(expandedOrder, i)
-			}
+		var newRow ResultRow
+		for _, column := range q.resultColumns {
+			newRow = append(newRow, row.table.project(column, row.row)...)
 		}
 
-		slices.SortFunc(source.Rows, func(a, b ResultRow) int {
-			var result int
-			for idx, i := range expandedOrder {
-				ai, bi := a[i], b[i]
-
-				aInt, bInt := coerceToInt(ai.Value), coerceToInt(bi.Value)
-
-				switch ai.Value.Kind() {
-				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-					if aInt == nil || bInt == nil {
-						// FIXME: What to do here?
-						continue
-					}
-					result = cmp.Compare(*aInt, *bInt)
-				case reflect.Float32, reflect.Float64:
-					result = cmp.Compare(ai.Value.Float(), bi.Value.Float())
-				case reflect.String:
-					result = cmp.Compare(ai.Value.String(), bi.Value.String())
-				case reflect.Struct:
-					if ai.Value.Type().Name() == "Time" {
-						if aInt == nil || bInt == nil {
-							// FIXME: What to do here?
-							continue
-						}
-						result = cmp.Compare(*aInt, *bInt)
-					}
-				}
+		r = append(r, newRow)
+		values[idx] = orderValues(keys, row, newRow)
+	}
 
-				if asc[idx] == false {
-					result *= -1
-				}
+	r = sortRows(r, values, q.order)
 
-				if result != 0 || len(expandedOrder)-1 == idx {
-					return result
-				}
-			}
+	if q.distinct {
+		r = distinctRows(r)
+	}
 
-			return result
-		})
+	return q.applyLimit(r)
+}
+
+// applyLimit discards the rows of r before the statement's OFFSET and
+// beyond its LIMIT
+func (q *QueryExecutor) applyLimit(r ResultRows) ResultRows {
+	if q.offset != nil {
+		if n := q.limitValue(q.offset); n > 0 {
+			r = r[min(n, int64(len(r))):]
+		}
 	}
 
-	// Limit
 	if q.limit != nil {
-		switch t := q.limit.(type) {
-		case *sql.NumberLit:
-			n, err := strconv.Atoi(t.Value)
-			if err != nil {
-				panic(err)
-			}
-			source.Rows = source.Rows[:n]
+		// A negative LIMIT means there is no limit
+		if n := q.limitValue(q.limit); n >= 0 {
+			r = r[:min(n, int64(len(r)))]
 		}
 	}
 
-	// Find column positions to narrow
-	var narrowColumns []int
-	for _, column := range q.resultColumns {
-		if column.Star.Line > 0 {
-			for idx, _ := range source.Rows[0] {
-				narrowColumns = append(narrowColumns, idx)
-			}
-			break
-		}
+	return r
+}
 
-		switch t := column.Expr.(type) {
-		case *sql.Ident:
-			index, ok := lookup[t.Name]
-			if !ok {
-				// FIXME: There should be a better way
-				parts := strings.Split(source.Columns[0], ".")
-				if len(parts) > 1 {
-					index = lookup[parts[0]+"."+t.Name]
-				}
-			}
+// limitClause returns the LIMIT and OFFSET expressions of a statement. In
+// the form "LIMIT a, b", a is the offset and b the limit.
+func limitClause(t *sql.SelectStatement) (limit, offset sql.Expr) {
+	switch {
+	case !t.Limit.IsValid():
+		return nil, nil
+	case t.OffsetComma.IsValid():
+		return t.OffsetExpr, t.LimitExpr
+	}
 
-			narrowColumns = append(narrowColumns, index)
-		case *sql.QualifiedRef:
-			if t.Star.Line != 0 {
-				// FIXME: Implement
-				continue
-			}
+	return t.LimitExpr, t.OffsetExpr
+}
 
-			lh := t.Table.Name
-			rh := t.Column.Name
-
-			var index int
-			var ok bool
-			if source.Source != nil {
-				index, ok = lookup[rh]
-			} else {
-				index, ok = lookup[lh+"."+rh]
-				if !ok {
-					index = lookup[source.Aliases[lh]+"."+rh]
-				}
-			}
+// limitValue evaluates the expression of a LIMIT or OFFSET clause, which as
+// in SQLite must be an integer, or a real or text which is exactly one
+func (q *QueryExecutor) limitValue(expr sql.Expr) int64 {
+	// The clause is evaluated once, without a row, and so cannot refer to
+	// any column
+	var f columnFinder
+	_, _ = sql.Walk(&f, expr)
+	for _, ident := range f.idents {
+		raise("no such column: %s", ident.Name)
+	}
+	for _, ref := range f.refs {
+		column := "*"
+		if ref.Column != nil {
+			column = ref.Column.Name
+		}
+		raise("no such column: %s.%s", ref.Table.Name, column)
+	}
 
-			narrowColumns = append(narrowColumns, index)
-		default:
-			narrowColumns = append(narrowColumns, 0)
+	table := &IntermediateTable{sqlizer: q.s, now: q.now, exec: q}
+	v := table.evaluate(expr, nil)
+
+	var n *float64
+	switch v.Kind() {
+	case reflect.String:
+		if parsed, err := strconv.ParseFloat(strings.TrimSpace(v.String()), 64); err == nil {
+			n = &parsed
 		}
+	case reflect.Struct:
+	default:
+		n = coerceToFloat(v)
 	}
 
-	// Find aggregations
-	var aggregations []AggregateFunctionColumn
-	for idx, column := range q.resultColumns {
-		switch t := column.Expr.(type) {
-		case *sql.Call:
-			var underlying string
-			if t.Star.Line == 0 {
-				if len(t.Args) != 1 {
-					panic("unexpected number of args to function")
-				}
+	if n == nil || *n != math.Trunc(*n) {
+		raise("datatype mismatch")
+	}
 
-				switch arg := t.Args[0].(type) {
-				case *sql.Ident:
-					// Validate?
-					index, ok := lookup[arg.Name]
-					if ok {
-						underlying = arg.Name
-						break
-					}
-
-					// FIXME: There should be a better way
-					parts := strings.Split(source.Columns[0], ".")
-					if len(parts) > 1 {
-						index, ok = lookup[parts[0]+"."+arg.Name]
-						if ok {
-							underlying = parts[0] + "." + arg.Name
-						}
-					}
-
-					narrowColumns[idx] = index
-				}
-			} else {
-				narrowColumns[idx] = 0
-			}
+	return int64(*n)
+}
 
-			aggregations = append(aggregations, AggregateFunctionColumn{
-				UnderlyingColumn: underlying,
-				ResultPosition:   idx,
-				Function:         functionMap[t.Name.Name],
-			})
-		}
+// groups collapses the rows of source into one row per group, discarding
+// any groups which do not satisfy the HAVING clause
+func (q *QueryExecutor) groups(source *IntermediateTable) []sourceRow {
+	groups := source.Group(q.groupingExprs(source))
+	if len(groups) == 0 && len(q.groupBy) == 0 {
+		// Without GROUP BY, aggregating no rows still produces a row
+		groups = append(groups, source)
 	}
 
-	for _, row := range source.Rows {
-		if len(row) == len(narrowColumns) {
-			r = append(r, row)
-			continue
+	having := q.havingExpr(source)
+
+	// When the statement calls a single min() or max(), bare columns take
+	// their value from the row which produced its result, as in SQLite
+	exprs := append(q.resultExprs(), having)
+	for _, term := range q.order {
+		exprs = append(exprs, term.X)
+	}
+	extreme := q.s.extremeCall(exprs...)
+
+	var rows []sourceRow
+	for _, group := range groups {
+		// Otherwise bare columns take their value from the last row of the
+		// group, or are NULL if there are no rows
+		bare := make(ResultRow, len(group.Columns))
+		if len(group.Rows) > 0 {
+			bare = group.Rows[len(group.Rows)-1]
 		}
 
-		var newRow ResultRow
-		for _, column := range narrowColumns {
-			newRow = append(newRow, row[column])
+		if extreme != nil {
+			acc := functionMap[strings.ToLower(extreme.Name.Name)].init().(*extremeAccumulator)
+			group.aggregate(extreme, acc, true)
+			if acc.row != nil {
+				bare = acc.row
+			}
 		}
-		r = append(r, newRow)
-	}
 
-	for _, aggregation := range aggregations {
-		r = aggregation.Call(r)
-	}
+		if having != nil {
+			if !isTrue(group.evaluate(having, bare)) {
+				continue
+			}
+		}
 
-	q.resultColumns = []*sql.ResultColumn{}
+		rows = append(rows, sourceRow{table: group, row: bare})
+	}
 
-	return r
+	return rows
 }
 
-func NewQueryExecutor(s *SQLizer, f func(table *IntermediateTable)) *QueryExecutor {
-	return &QueryExecutor{
-		FillIntermediate: f,
-		s:                s,
+// resultExprs returns the expressions of the statement's result columns
+func (q *QueryExecutor) resultExprs() []sql.Expr {
+	var exprs []sql.Expr
+	for _, column := range q.resultColumns {
+		if column.Expr != nil {
+			exprs = append(exprs, column.Expr)
+		}
 	}
-}
 
-type IntermediateVisitor interface {
-	sql.Visitor
-	Result() *IntermediateTable
+	return exprs
 }
 
-type QualifiedTableVisitor struct {
-	F     *QueryExecutor
-	Table *IntermediateTable
-}
+// groupingExprs resolves GROUP BY terms which refer to a result column, either
+// by position (GROUP BY 1) or by alias, into the result column's expression
+func (q *QueryExecutor) groupingExprs(source *IntermediateTable) []sql.Expr {
+	var exprs []sql.Expr
 
-func (i *QualifiedTableVisitor) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
-	switch t := n.(type) {
-	case *sql.QualifiedTableName:
-		i.Table = NewIntermediateTable()
-		i.Table.Source = i.F.s.Tables[t.TableName()]
+	for _, expr := range q.groupBy {
+		switch t := expr.(type) {
+		case *sql.NumberLit:
+			n, err := strconv.Atoi(t.Value)
+			if err == nil && n > 0 && n <= len(q.resultColumns) && q.resultColumns[n-1].Expr != nil {
+				expr = q.resultColumns[n-1].Expr
+			}
+		case *sql.Ident:
+			if source.identIndex(t.Name) > -1 {
+				break
+			}
 
-		if t.Alias != nil {
-			i.Table.Aliases[t.Alias.Name] = t.Name.Name
+			for _, column := range q.resultColumns {
+				if column.Alias != nil && column.Alias.Name == t.Name {
+					expr = column.Expr
+					break
+				}
+			}
 		}
 
-		i.F.FillIntermediate(i.Table)
+		exprs = append(exprs, expr)
 	}
-	return i, n, nil
-}
 
-func (i *QualifiedTableVisitor) VisitEnd(n sql.Node) (sql.Node, error) {
-	return n, nil
+	return exprs
 }
 
-func (i *QualifiedTableVisitor) Result() *IntermediateTable {
-	return i.Table
-}
+// havingExpr returns the HAVING clause with the names in it which refer to
+// a result column by its alias, rather than to a column of source, resolved
+// into the result column's expression as groupingExprs does for GROUP BY
+func (q *QueryExecutor) havingExpr(source *IntermediateTable) sql.Expr {
+	if q.having == nil {
+		return nil
+	}
 
-type JoinVisitor struct {
-	F          *QueryExecutor
-	JoinResult *IntermediateTable
-	Sources    []*IntermediateTable
-	Previous   IntermediateVisitor
+	r := &aliasResolver{
+		source:  source,
+		aliases: make(map[string]sql.Expr),
+		calls:   make(map[*sql.Ident]bool),
+	}
+	for _, column := range q.resultColumns {
+		if column.Alias == nil || column.Expr == nil {
+			continue
+		}
+		if _, ok := r.aliases[column.Alias.Name]; !ok {
+			r.aliases[column.Alias.Name] = column.Expr
+		}
+	}
+
+	if len(r.aliases) == 0 {
+		return q.having
+	}
+
+	// The clause is resolved in a copy, since the statement may be
+	// executed again
+	having, err := sql.Walk(r, sql.CloneExpr(q.having))
+	if err != nil {
+		return q.having
+	}
+
+	return having.(sql.Expr)
 }
 
-func (j *JoinVisitor) Result() *IntermediateTable {
-	return j.JoinResult
+// aliasResolver replaces the names of result columns' aliases with the
+// columns' expressions. Names which are not column references, such as
+// those of functions and types, and the columns of source and of
+// subqueries are left as they are.
+type aliasResolver struct {
+	source  *IntermediateTable
+	aliases map[string]sql.Expr
+	calls   map[*sql.Ident]bool
 }
 
-func (j *JoinVisitor) joinRowOn(row ResultRow, expr sql.Expr) ResultRows {
-	from := j.Sources[len(j.Sources)-2]
-	to := j.Sources[len(j.Sources)-1]
+func (r *aliasResolver) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
+	switch t := n.(type) {
+	case *sql.Call:
+		r.calls[t.Name] = true
+	case *sql.QualifiedRef, *sql.Type, *sql.OverClause, *sql.Exists:
+		return nil, n, nil
+	}
 
-	var results ResultRows
+	return r, n, nil
+}
 
-	switch t := expr.(type) {
-	case *sql.BinaryExpr:
-		var a, b string
-		var swapped bool
+func (r *aliasResolver) VisitEnd(n sql.Node) (sql.Node, error) {
+	t, ok := n.(*sql.Ident)
+	if !ok || r.calls[t] || r.source.identIndex(t.Name) > -1 {
+		return n, nil
+	}
 
-		op := t.Op
+	if expr, ok := r.aliases[t.Name]; ok {
+		return expr, nil
+	}
 
-		for idx, x := range []sql.Expr{t.X, t.Y} {
-			switch n := x.(type) {
-			case *sql.Ident:
-				if from.Source == nil {
-					return nil
-				}
+	return n, nil
+}
 
-				if _, ok := from.Source.ColumnMappings[n.Name]; ok {
-					if a == "" {
-						a = n.Name
-					} else {
-						b = n.Name
-					}
-				}
-			case *sql.QualifiedRef:
-				var table *IntermediateTable
-				var tableName string
-				var columnName string
+// isAggregate reports whether the query collapses rows into groups, either
+// explicitly via GROUP BY / HAVING or implicitly by selecting an aggregate
+func (q *QueryExecutor) isAggregate() bool {
+	if len(q.groupBy) > 0 || q.having != nil {
+		return true
+	}
 
-				if n.Star.Line > 0 {
-					columnName = "*"
-				}
+	for _, column := range q.resultColumns {
+		if column.Expr != nil && q.s.containsAggregate(column.Expr) {
+			return true
+		}
+	}
 
-				if columnName == "" {
-					columnName = n.Column.Name
-				}
+	for _, term := range q.order {
+		if q.s.containsAggregate(term.X) {
+			return true
+		}
+	}
 
-				if from.Source != nil && n.Table != nil {
-					if from.Source.Name == n.Table.Name {
-						tableName = n.Table.Name
-						table = from
-					} else if _, ok := from.Aliases[n.Table.Name]; ok && from.Aliases[n.Table.Name] == from.Source.Name {
-						tableName = from.Aliases[n.Table.Name]
-						table = from
-					}
-
-					if table != nil {
-						if a != "" {
-							b = a
-						}
-						a = tableName + "." + columnName
-
-						if idx == 1 {
-							swapped = true
-						}
-					}
-				}
+	return false
+}
 
-				if table == nil && to.Source != nil && n.Table != nil {
-					if to.Source.Name == n.Table.Name {
-						tableName = n.Table.Name
-						table = to
-					} else if _, ok := to.Aliases[n.Table.Name]; ok && to.Aliases[n.Table.Name] == to.Source.Name {
-						tableName = to.Aliases[n.Table.Name]
-						table = to
-					}
-
-					if table != nil {
-						if b != "" {
-							a = b
-						}
-						b = tableName + "." + columnName
-						if idx == 0 {
-							swapped = true
-						}
-					}
-				}
+// columnName returns the name a result column is reported under. As in
+// SQLite, this is the alias if one is given, the column name for a plain
+// column reference, and otherwise the text of the expression.
+func columnName(column *sql.ResultColumn) string {
+	if column.Alias != nil {
+		return column.Alias.Name
+	}
 
-				if table == nil {
-					return nil
-				}
-			}
+	switch t := column.Expr.(type) {
+	case *sql.Ident:
+		return t.Name
+	case *sql.QualifiedRef:
+		if t.Column != nil {
+			return t.Column.Name
 		}
+	}
 
-		if swapped {
-			switch op {
-			case sql.LT:
-				op = sql.GE
-			case sql.GT:
-				op = sql.LE
-			case sql.GE:
-				op = sql.LT
-			case sql.LE:
-				op = sql.GT
-			case sql.EQ:
-				// DO nothing
-			default:
-				panic("unhandled default case")
-			}
+	if column.Expr == nil {
+		return ""
+	}
+
+	return unquoteIdents(nodeString(column.Expr))
+}
+
+// unquoteIdents removes the double quotes the parser adds around every
+// identifier when formatting an expression, keeping them only where the
+// identifier could not be written without them
+func unquoteIdents(s string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		quote := s[i]
+		if quote != '\'' && quote != '"' {
+			b.WriteByte(quote)
+			continue
 		}
 
-		var fromValue ResultValue
-		for _, value := range row {
-			if value.Name == a || from.Source.Name+"."+value.Name == a {
-				fromValue = value
+		// Find the closing quote, skipping over doubled (escaped) quotes
+		end := i + 1
+		for end < len(s) {
+			if s[end] == quote {
+				if end+1 < len(s) && s[end+1] == quote {
+					end += 2
+					continue
+				}
 				break
 			}
+			end++
 		}
 
-		if fromValue.Name == "" {
-			return nil
+		if quote == '"' && end < len(s) && isBareIdent(s[i+1:end]) {
+			b.WriteString(s[i+1 : end])
+		} else {
+			b.WriteString(s[i:min(end+1, len(s))])
 		}
+		i = end
+	}
 
-		for _, targetRow := range to.Rows {
-			index := -1
-
-			for idx, value := range targetRow {
-				if value.Name == b || to.Source.Name+"."+value.Name == b {
-					// FIXME: Handle other operators
-					if fromValue.Value.Equal(value.Value) {
-						index = idx
-					}
-					break
-				}
-			}
+	return b.String()
+}
 
-			if index > -1 {
-				var r ResultRow
+// isBareIdent reports whether s can be written as an identifier without
+// quoting
+func isBareIdent(s string) bool {
+	if s == "" || sql.Lookup(s) != sql.IDENT {
+		return false
+	}
 
-				for _, c := range row {
-					r = append(r, ResultValue{
-						Name:  from.Source.Name + "." + c.Name,
-						Value: c.Value,
-					})
-				}
+	for i, r := range s {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
 
-				for _, c := range targetRow {
-					r = append(r, ResultValue{
-						Name:  to.Source.Name + "." + c.Name,
-						Value: c.Value,
-					})
-				}
+	return true
+}
 
-				results = append(results, r)
-			}
-		}
+func NewQueryExecutor(s *SQLizer, f func(table *IntermediateTable)) *QueryExecutor {
+	return &QueryExecutor{
+		FillIntermediate: f,
+		s:                s,
 	}
+}
 
-	return results
+type IntermediateVisitor interface {
+	sql.Visitor
+	Result() *IntermediateTable
 }
 
-func (j *JoinVisitor) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
+type QualifiedTableVisitor struct {
+	F     *QueryExecutor
+	Table *IntermediateTable
+
+	// cte is the common table expression the table name refers to, if
+	// any, and alias the name it is given
+	cte   *commonTable
+	alias string
+}
+
+func (i *QualifiedTableVisitor) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
 	switch t := n.(type) {
 	case *sql.QualifiedTableName:
-		if j.Previous != nil {
-			j.Sources = append(j.Sources, j.Previous.Result())
-		}
+		if c := i.F.commonTable(t.Name.Name); c != nil {
+			i.cte = c
+			if t.Alias != nil {
+				i.alias = t.Alias.Name
+			}
 
-		j.Previous = &QualifiedTableVisitor{F: j.F}
-		return j.Previous.Visit(n)
-	case *sql.OnConstraint:
-		if j.Previous != nil && j.Sources[len(j.Sources)-1] != j.Previous.Result() {
-			j.Sources = append(j.Sources, j.Previous.Result())
+			return i, n, nil
 		}
 
-		j.JoinResult = &IntermediateTable{}
-		j.JoinResult.Aliases = j.Sources[len(j.Sources)-2].Aliases
+		i.Table = NewIntermediateTable()
+		i.Table.Source = i.F.s.Tables[t.Name.Name]
 
-		for k, v := range j.Sources[len(j.Sources)-1].Aliases {
-			j.JoinResult.Aliases[k] = v
+		if t.Alias != nil {
+			i.Table.Aliases[t.Alias.Name] = t.Name.Name
 		}
 
-		for _, row := range j.Sources[len(j.Sources)-2].Rows {
-			rows := j.joinRowOn(row, t.X)
-			if len(j.JoinResult.Columns) == 0 && len(rows) > 0 {
-				for _, column := range rows[0] {
-					j.JoinResult.Columns = append(j.JoinResult.Columns, column.Name)
-				}
-			}
-			j.JoinResult.Rows = append(j.JoinResult.Rows, rows...)
-		}
+		i.F.fill(i.Table)
 	}
+	return i, n, nil
+}
 
-	return j, n, nil
+func (i *QualifiedTableVisitor) VisitEnd(n sql.Node) (sql.Node, error) {
+	return n, nil
 }
 
-func (j *JoinVisitor) VisitEnd(n sql.Node) (sql.Node, error) {
-	switch n.(type) {
-	case *sql.JoinClause:
+// Result returns the table. A common table expression is read while the
+// statement is executed, since reading it may execute its statement.
+func (i *QualifiedTableVisitor) Result() *IntermediateTable {
+	if i.Table == nil && i.cte != nil {
+		i.Table = i.cte.read()
+
+		if i.alias != "" {
+			i.Table.Aliases[i.alias] = i.Table.Source.Name
+		}
 	}
-	return n, nil
+
+	return i.Table
 }
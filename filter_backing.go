@@ -15,6 +15,14 @@ func (f *SliceFilter) Rows() ResultRows {
 	return f.exec.Rows()
 }
 
+func (f *SliceFilter) RowsWithError() (ResultRows, error) {
+	return f.exec.RowsWithError()
+}
+
+func (f *SliceFilter) execute(n sql.Node, e *execution) (ResultRows, error) {
+	return NewQueryExecutor(f.s, f.FillIntermediate).run(n, e)
+}
+
 func (f *SliceFilter) FillIntermediate(table *IntermediateTable) {
 	if table.Source == nil {
 		panic("cannot fill intermediate without a table")
@@ -37,21 +45,10 @@ func (f *SliceFilter) FillIntermediate(table *IntermediateTable) {
 			}
 
 			for i := 0; i < v.Len(); i++ {
-				var result ResultRow
-				for _, column := range table.Source.Columns {
-					result = append(result, ResultValue{Name: column, Value: v.Index(i).Elem().FieldByName(table.Source.ColumnMappings[column].GoField)})
-				}
-				table.Rows = append(table.Rows, result)
+				table.Rows = append(table.Rows, table.Source.rowFor(v.Index(i)))
 			}
 		} else {
-			v := reflect.ValueOf(d)
-
-			var result ResultRow
-			for _, column := range table.Source.Columns {
-				result = append(result, ResultValue{Name: column, Value: v.Elem().FieldByName(table.Source.ColumnMappings[column].GoField)})
-			}
-
-			table.Rows = append(table.Rows, result)
+			table.Rows = append(table.Rows, table.Source.rowFor(reflect.ValueOf(d)))
 		}
 	}
 }
@@ -0,0 +1,644 @@
+package duckql
+
+import (
+	"encoding/hex"
+	"errors"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rqlite/sql"
+)
+
+// ScalarFunction computes the result of a scalar SQL function from the
+// values of its arguments. NULL arguments are passed as invalid values.
+type ScalarFunction func(args []reflect.Value) reflect.Value
+
+// scalarFunction is an entry in the registry of scalar functions, along with
+// the number of arguments it accepts. A maxArgs of -1 means no limit.
+type scalarFunction struct {
+	minArgs  int
+	maxArgs  int
+	function ScalarFunction
+}
+
+var scalarFunctionMap = map[string]scalarFunction{
+	"abs":       {1, 1, absFunction},
+	"char":      {0, -1, charFunction},
+	"coalesce":  {2, -1, coalesceFunction},
+	"format":    {1, -1, printfFunction},
+	"hex":       {1, 1, hexFunction},
+	"ifnull":    {2, 2, coalesceFunction},
+	"iif":       {2, 3, iifFunction},
+	"instr":     {2, 2, instrFunction},
+	"length":    {1, 1, lengthFunction},
+	"lower":     {1, 1, lowerFunction},
+	"ltrim":     {1, 2, trimFunction(true, false)},
+	"max":       {2, -1, maxFunction},
+	"min":       {2, -1, minFunction},
+	"nullif":    {2, 2, nullifFunction},
+	"printf":    {1, -1, printfFunction},
+	"quote":     {1, 1, quoteFunction},
+	"replace":   {3, 3, replaceFunction},
+	"round":     {1, 2, roundFunction},
+	"rtrim":     {1, 2, trimFunction(false, true)},
+	"sign":      {1, 1, signFunction},
+	"substr":    {2, 3, substrFunction},
+	"substring": {2, 3, substrFunction},
+	"trim":      {1, 2, trimFunction(true, true)},
+	"typeof":    {1, 1, typeofFunction},
+	"upper":     {1, 1, upperFunction},
+}
+
+// registeredFunction is a function added with RegisterFunction or
+// RegisterAggregate. Exactly one of scalar and aggregate is set.
+type registeredFunction struct {
+	name       string
+	arity      int
+	returnType string
+	scalar     ScalarFunction
+	aggregate  func(call *sql.Call) Accumulator
+}
+
+func (f *registeredFunction) minArgs() int {
+	return max(f.arity, 0)
+}
+
+func (f *registeredFunction) maxArgs() int {
+	return f.arity
+}
+
+// signature describes the function in the form shown by DDL()
+func (f *registeredFunction) signature() string {
+	var b strings.Builder
+
+	if f.aggregate != nil {
+		b.WriteString("AGGREGATE ")
+	}
+	b.WriteString("FUNCTION " + f.name + "(")
+
+	if f.arity < 0 {
+		b.WriteString("...")
+	}
+	for i := 0; i < f.arity; i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("arg" + strconv.Itoa(i+1))
+	}
+	b.WriteString(")")
+
+	if f.returnType != "" {
+		b.WriteString(" RETURNS " + f.returnType)
+	}
+
+	return b.String()
+}
+
+// registeredFunction returns the function registered under name, if any
+func (s *SQLizer) registeredFunction(name string) (*registeredFunction, bool) {
+	if s == nil {
+		return nil, false
+	}
+
+	f, ok := s.functions[strings.ToLower(name)]
+	return f, ok
+}
+
+// isAggregateCall reports whether call invokes an aggregate function. The
+// functions min() and max() are aggregates with a single argument, and
+// scalar functions with more than one.
+func (s *SQLizer) isAggregateCall(call *sql.Call) bool {
+	// An aggregate function called with OVER is a window function
+	if call.Over != nil {
+		return false
+	}
+
+	name := strings.ToLower(call.Name.Name)
+
+	if f, ok := s.registeredFunction(name); ok {
+		return f.aggregate != nil
+	}
+
+	if _, ok := functionMap[name]; !ok {
+		return false
+	}
+
+	if _, ok := scalarFunctionMap[name]; ok && len(call.Args) > 1 {
+		return false
+	}
+
+	return true
+}
+
+// checkCall reports an error if call names a function which does not exist,
+// or passes it the wrong number of arguments
+func (s *SQLizer) checkCall(call *sql.Call) error {
+	if call.Over != nil {
+		return s.checkWindowCall(call)
+	}
+
+	name := strings.ToLower(call.Name.Name)
+
+	nargs := len(call.Args)
+	wrongArguments := errors.New("duckql: wrong number of arguments to function " + call.Name.Name + "()")
+
+	arity := func(minArgs, maxArgs int) error {
+		if call.Star.Line != 0 || nargs < minArgs || (maxArgs >= 0 && nargs > maxArgs) {
+			return wrongArguments
+		}
+		return nil
+	}
+
+	// An aggregate called with DISTINCT must also have exactly one argument
+	distinct := func(err error) error {
+		if err == nil && call.Distinct.IsValid() && nargs != 1 {
+			return errors.New("duckql: DISTINCT aggregates must have exactly one argument")
+		}
+		return err
+	}
+
+	// Only an aggregate may have a FILTER clause
+	scalar := func(err error) error {
+		if err == nil && call.Filter != nil {
+			return errors.New("duckql: FILTER may not be used with non-aggregate " + call.Name.Name + "()")
+		}
+		return err
+	}
+
+	if f, ok := s.registeredFunction(name); ok {
+		if f.aggregate != nil {
+			return distinct(arity(f.minArgs(), f.maxArgs()))
+		}
+		return scalar(arity(f.minArgs(), f.maxArgs()))
+	}
+
+	if s.isAggregateCall(call) {
+		if call.Star.Line != 0 {
+			if name != "count" {
+				return wrongArguments
+			}
+			return nil
+		}
+
+		f := functionMap[name]
+		return distinct(arity(f.minArgs, f.maxArgs))
+	}
+
+	if f, ok := scalarFunctionMap[name]; ok {
+		return scalar(arity(f.minArgs, f.maxArgs))
+	}
+
+	if f, ok := dateTimeFunctionMap[name]; ok {
+		return scalar(arity(f.minArgs, f.maxArgs))
+	}
+
+	if _, ok := windowFunctionMap[name]; ok {
+		return errors.New("duckql: misuse of window function " + call.Name.Name + "()")
+	}
+
+	// Queries handed to SQLite may use any function it provides
+	if _, ok := s.Backing.(*SQLiteBacking); ok {
+		return nil
+	}
+
+	return errors.New("duckql: no such function: " + call.Name.Name)
+}
+
+// evaluateArguments checks that call passes between minArgs and maxArgs
+// arguments (with no upper limit if maxArgs is -1), and evaluates them
+func (i *IntermediateTable) evaluateArguments(call *sql.Call, minArgs, maxArgs int, row ResultRow) []reflect.Value {
+	checkArity(call, minArgs, maxArgs)
+
+	args := make([]reflect.Value, len(call.Args))
+	for idx, arg := range call.Args {
+		args[idx] = i.evaluate(arg, row)
+	}
+
+	return args
+}
+
+// checkArity raises an error unless call passes between minArgs and maxArgs
+// arguments (with no upper limit if maxArgs is -1)
+func checkArity(call *sql.Call, minArgs, maxArgs int) {
+	if call.Star.Line != 0 || len(call.Args) < minArgs || (maxArgs >= 0 && len(call.Args) > maxArgs) {
+		raise("wrong number of arguments to function %s()", call.Name.Name)
+	}
+}
+
+// anyNull reports whether any of args is NULL
+func anyNull(args []reflect.Value) bool {
+	for _, arg := range args {
+		if !arg.IsValid() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mapASCII applies f to the ASCII letters of s, leaving every other
+// character untouched, as SQLite's lower() and upper() do
+func mapASCII(s string, f func(byte) byte) string {
+	b := []byte(s)
+	for idx, c := range b {
+		if c < utf8.RuneSelf {
+			b[idx] = f(c)
+		}
+	}
+
+	return string(b)
+}
+
+func lowerFunction(args []reflect.Value) reflect.Value {
+	if !args[0].IsValid() {
+		return null
+	}
+
+	return reflect.ValueOf(mapASCII(coerceToString(args[0]), func(c byte) byte {
+		if c >= 'A' && c <= 'Z' {
+			return c + ('a' - 'A')
+		}
+		return c
+	}))
+}
+
+func upperFunction(args []reflect.Value) reflect.Value {
+	if !args[0].IsValid() {
+		return null
+	}
+
+	return reflect.ValueOf(mapASCII(coerceToString(args[0]), func(c byte) byte {
+		if c >= 'a' && c <= 'z' {
+			return c - ('a' - 'A')
+		}
+		return c
+	}))
+}
+
+func lengthFunction(args []reflect.Value) reflect.Value {
+	x := args[0]
+	if !x.IsValid() {
+		return null
+	}
+
+	if isBlob(x) {
+		return reflect.ValueOf(int64(x.Len()))
+	}
+
+	return reflect.ValueOf(int64(utf8.RuneCountInString(coerceToString(x))))
+}
+
+// substrFunction implements substr(x, y[, z]), returning z characters of x
+// starting at the y-th, where the first character is numbered 1. A negative
+// y counts from the end of x, and a negative z returns the characters
+// preceding the y-th instead.
+func substrFunction(args []reflect.Value) reflect.Value {
+	if anyNull(args) {
+		return null
+	}
+
+	runes := []rune(coerceToString(args[0]))
+	length := int64(len(runes))
+
+	// Without a third argument, the rest of the string is returned
+	p1 := toInteger(args[1])
+	p2 := int64(math.MaxInt64)
+
+	negative := false
+	if len(args) == 3 {
+		p2 = toInteger(args[2])
+		if p2 < 0 {
+			p2 = -p2
+			negative = true
+		}
+	}
+
+	// This follows the arithmetic of SQLite's substrFunc()
+	if p1 < 0 {
+		p1 += length
+		if p1 < 0 {
+			p2 += p1
+			if p2 < 0 {
+				p2 = 0
+			}
+			p1 = 0
+		}
+	} else if p1 > 0 {
+		p1--
+	} else if p2 > 0 {
+		p2--
+	}
+
+	if negative {
+		p1 -= p2
+		if p1 < 0 {
+			p2 += p1
+			p1 = 0
+		}
+	}
+
+	if p1 > length {
+		p1 = length
+	}
+
+	if p2 > length-p1 {
+		p2 = length - p1
+	}
+
+	return reflect.ValueOf(string(runes[p1 : p1+p2]))
+}
+
+// trimFunction returns the implementation of trim(), ltrim() or rtrim(),
+// which remove any of the characters in their second argument (by default,
+// only spaces) from the left and/or right of the first
+func trimFunction(left, right bool) ScalarFunction {
+	return func(args []reflect.Value) reflect.Value {
+		if anyNull(args) {
+			return null
+		}
+
+		s := coerceToString(args[0])
+
+		cutset := " "
+		if len(args) == 2 {
+			cutset = coerceToString(args[1])
+		}
+
+		if left {
+			s = strings.TrimLeft(s, cutset)
+		}
+		if right {
+			s = strings.TrimRight(s, cutset)
+		}
+
+		return reflect.ValueOf(s)
+	}
+}
+
+func replaceFunction(args []reflect.Value) reflect.Value {
+	if anyNull(args) {
+		return null
+	}
+
+	s, old := coerceToString(args[0]), coerceToString(args[1])
+	if old == "" {
+		return reflect.ValueOf(s)
+	}
+
+	return reflect.ValueOf(strings.ReplaceAll(s, old, coerceToString(args[2])))
+}
+
+// instrFunction implements instr(x, y), returning the character position of
+// the first occurrence of y within x, or 0 if there is none
+func instrFunction(args []reflect.Value) reflect.Value {
+	if anyNull(args) {
+		return null
+	}
+
+	s, substr := coerceToString(args[0]), coerceToString(args[1])
+
+	idx := strings.Index(s, substr)
+	if idx < 0 {
+		return reflect.ValueOf(int64(0))
+	}
+
+	return reflect.ValueOf(int64(utf8.RuneCountInString(s[:idx]) + 1))
+}
+
+func absFunction(args []reflect.Value) reflect.Value {
+	x := args[0]
+	if !x.IsValid() {
+		return null
+	}
+
+	n := toNumeric(x)
+	if x.Kind() == reflect.String {
+		return reflect.ValueOf(math.Abs(n.float()))
+	}
+
+	if !n.isInt {
+		return reflect.ValueOf(math.Abs(n.f))
+	}
+
+	if n.i == math.MinInt64 {
+		raise("integer overflow")
+	}
+
+	if n.i < 0 {
+		return reflect.ValueOf(-n.i)
+	}
+
+	return reflect.ValueOf(n.i)
+}
+
+// signFunction implements sign(x), returning -1, 0 or 1 as x is negative,
+// zero or positive, or NULL if x is NULL or not a number
+func signFunction(args []reflect.Value) reflect.Value {
+	x := applyNumericAffinity(args[0])
+	if !x.IsValid() || x.Kind() == reflect.String || isBlob(x) {
+		return null
+	}
+
+	f := coerceToFloat(x)
+	if f == nil {
+		return null
+	}
+
+	switch {
+	case *f > 0:
+		return reflect.ValueOf(int64(1))
+	case *f < 0:
+		return reflect.ValueOf(int64(-1))
+	}
+
+	return reflect.ValueOf(int64(0))
+}
+
+// roundFunction implements round(x[, y]), rounding x to y digits after the
+// decimal point (by default, none). The result is always a real.
+func roundFunction(args []reflect.Value) reflect.Value {
+	if anyNull(args) {
+		return null
+	}
+
+	f := toNumeric(args[0]).float()
+
+	var digits int64
+	if len(args) == 2 {
+		digits = max(toInteger(args[1]), 0)
+	}
+
+	if digits == 0 {
+		return reflect.ValueOf(math.Round(f))
+	}
+
+	if digits > 30 {
+		return reflect.ValueOf(f)
+	}
+
+	rounded, err := strconv.ParseFloat(strconv.FormatFloat(f, 'f', int(digits), 64), 64)
+	if err != nil {
+		return reflect.ValueOf(f)
+	}
+
+	return reflect.ValueOf(rounded)
+}
+
+// coalesceFunction implements coalesce() and ifnull(), returning the first
+// argument which is not NULL
+func coalesceFunction(args []reflect.Value) reflect.Value {
+	for _, arg := range args {
+		if arg.IsValid() {
+			return arg
+		}
+	}
+
+	return null
+}
+
+// nullifFunction implements nullif(x, y), returning x unless it is equal to
+// y, in which case the result is NULL
+func nullifFunction(args []reflect.Value) reflect.Value {
+	x, y := args[0], args[1]
+	if x.IsValid() && y.IsValid() && valuesEqual(x, y) {
+		return null
+	}
+
+	return x
+}
+
+// iifFunction implements iif(x, y[, z]), returning y if x is true and z (or
+// NULL) otherwise
+func iifFunction(args []reflect.Value) reflect.Value {
+	if isTrue(args[0]) {
+		return args[1]
+	}
+
+	if len(args) == 3 {
+		return args[2]
+	}
+
+	return null
+}
+
+// hexFunction implements hex(x), returning the bytes of a blob, or of the
+// text of any other value, as upper-case hexadecimal. hex(NULL) is empty.
+func hexFunction(args []reflect.Value) reflect.Value {
+	x := args[0]
+	if !x.IsValid() {
+		return reflect.ValueOf("")
+	}
+
+	if isBlob(x) {
+		return reflect.ValueOf(strings.ToUpper(hex.EncodeToString(x.Bytes())))
+	}
+
+	return reflect.ValueOf(strings.ToUpper(hex.EncodeToString([]byte(coerceToString(x)))))
+}
+
+// quoteFunction implements quote(x), returning the text of an SQL literal
+// for x: text in single quotes, a blob as X'...', and NULL as NULL
+func quoteFunction(args []reflect.Value) reflect.Value {
+	x := args[0]
+
+	switch {
+	case !x.IsValid():
+		return reflect.ValueOf("NULL")
+	case x.Kind() == reflect.String:
+		return reflect.ValueOf("'" + strings.ReplaceAll(x.String(), "'", "''") + "'")
+	case isBlob(x):
+		return reflect.ValueOf("X'" + strings.ToUpper(hex.EncodeToString(x.Bytes())) + "'")
+	case coerceToFloat(x) != nil:
+		return reflect.ValueOf(coerceToString(x))
+	}
+
+	return reflect.ValueOf("'" + strings.ReplaceAll(coerceToString(x), "'", "''") + "'")
+}
+
+// charFunction implements char(x, ...), returning the text whose characters
+// have the code points given by its arguments. Code points which are not
+// valid are replaced with U+FFFD.
+func charFunction(args []reflect.Value) reflect.Value {
+	var b strings.Builder
+	for _, arg := range args {
+		r := toInteger(arg)
+		if r < 0 || r > unicode.MaxRune {
+			r = unicode.ReplacementChar
+		}
+		b.WriteRune(rune(r))
+	}
+
+	return reflect.ValueOf(b.String())
+}
+
+// isBlob reports whether x is a blob, which is held as a []byte
+func isBlob(x reflect.Value) bool {
+	return x.Kind() == reflect.Slice && x.Type().Elem().Kind() == reflect.Uint8
+}
+
+// typeofFunction implements typeof(x), returning the name of the SQLite
+// storage class of x
+func typeofFunction(args []reflect.Value) reflect.Value {
+	x := args[0]
+
+	switch x.Kind() {
+	case reflect.Invalid:
+		return reflect.ValueOf("null")
+	case reflect.String:
+		return reflect.ValueOf("text")
+	case reflect.Float32, reflect.Float64:
+		return reflect.ValueOf("real")
+	case reflect.Slice:
+		if x.Type().Elem().Kind() == reflect.Uint8 {
+			return reflect.ValueOf("blob")
+		}
+	}
+
+	if coerceToInt(x) != nil {
+		return reflect.ValueOf("integer")
+	}
+
+	return reflect.ValueOf("text")
+}
+
+// maxFunction implements the scalar max(x, y, ...), returning the largest
+// of its arguments, or NULL if any argument is NULL
+func maxFunction(args []reflect.Value) reflect.Value {
+	return extremum(args, 1)
+}
+
+// minFunction implements the scalar min(x, y, ...), returning the smallest
+// of its arguments, or NULL if any argument is NULL
+func minFunction(args []reflect.Value) reflect.Value {
+	return extremum(args, -1)
+}
+
+func extremum(args []reflect.Value, direction int) reflect.Value {
+	if anyNull(args) {
+		return null
+	}
+
+	result := args[0]
+	for _, arg := range args[1:] {
+		if compareValues(arg, result)*direction > 0 {
+			result = arg
+		}
+	}
+
+	return result
+}
+
+// toInteger converts x to an integer as SQLite does for integer arguments,
+// truncating any fractional part
+func toInteger(x reflect.Value) int64 {
+	n := toNumeric(x)
+	if n.isInt {
+		return n.i
+	}
+
+	return int64(n.f)
+}
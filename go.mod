@@ -6,6 +6,7 @@ require (
 	github.com/hexops/gotextdiff v1.0.3
 	github.com/mattn/go-sqlite3 v1.14.28
 	github.com/rqlite/sql v0.0.0-20250623131620-453fa49cad04
+	google.golang.org/api v0.246.0
 )
 
 require (
@@ -29,7 +30,6 @@ require (
 	golang.org/x/oauth2 v0.30.0 // indirect
 	golang.org/x/sys v0.34.0 // indirect
 	golang.org/x/text v0.27.0 // indirect
-	google.golang.org/api v0.246.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20250728155136-f173205681a0 // indirect
 	google.golang.org/grpc v1.74.2 // indirect
 	google.golang.org/protobuf v1.36.6 // indirect
@@ -0,0 +1,493 @@
+package duckql
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/rqlite/sql"
+)
+
+// joinType is the type of a join, which determines what happens to rows of
+// either side which match no row of the other
+type joinType int
+
+const (
+	// innerJoin discards unmatched rows. CROSS and comma joins are inner
+	// joins which usually have no constraint.
+	innerJoin joinType = iota
+	// leftJoin keeps unmatched rows of the left side
+	leftJoin
+	// rightJoin keeps unmatched rows of the right side
+	rightJoin
+	// fullJoin keeps unmatched rows of both sides
+	fullJoin
+)
+
+// joinTypeOf returns the type of the join performed by op
+func (e *execution) joinTypeOf(op *sql.JoinOperator) joinType {
+	if op == nil || !op.Left.IsValid() {
+		return innerJoin
+	}
+
+	if e != nil {
+		if typ, ok := e.joins[op]; ok {
+			return typ
+		}
+	}
+
+	return leftJoin
+}
+
+// joinStep is a single source joined onto every source before it
+type joinStep struct {
+	operator   *sql.JoinOperator
+	source     sql.Source
+	constraint sql.JoinConstraint
+}
+
+// flattenJoin returns the first source of a join clause, followed by a step
+// for each source joined onto it in the order they were written. The parser
+// nests every join after the first inside the right side of the clause,
+// leaving the constraint of the first join on the outermost clause.
+func flattenJoin(clause *sql.JoinClause) (sql.Source, []joinStep) {
+	first := clause.X
+
+	var steps []joinStep
+	if x, ok := clause.X.(*sql.JoinClause); ok {
+		first, steps = flattenJoin(x)
+	}
+
+	if y, ok := clause.Y.(*sql.JoinClause); ok {
+		source, rest := flattenJoin(y)
+		steps = append(steps, joinStep{operator: clause.Operator, source: source, constraint: clause.Constraint})
+		return first, append(steps, rest...)
+	}
+
+	return first, append(steps, joinStep{operator: clause.Operator, source: clause.Y, constraint: clause.Constraint})
+}
+
+type JoinVisitor struct {
+	F          *QueryExecutor
+	JoinResult *IntermediateTable
+	Sources    []*IntermediateTable
+
+	// names holds the name by which each source is referred to, which is
+	// its alias if it has one
+	names    []string
+	steps    []joinStep
+	visitors []IntermediateVisitor
+}
+
+// Result joins the sources, evaluating the constraint of each join. It is
+// called while the statement is executed, so that errors raised by the
+// evaluator, or by the subqueries of derived tables, are reported by Rows.
+func (j *JoinVisitor) Result() *IntermediateTable {
+	if j.JoinResult == nil && len(j.visitors) > 0 {
+		j.Sources = nil
+		for _, v := range j.visitors {
+			j.Sources = append(j.Sources, v.Result())
+		}
+
+		result := qualifyColumns(j.Sources[0], j.names[0])
+		for idx, step := range j.steps {
+			result = j.join(result, step, j.Sources[idx+1], j.names[idx+1])
+		}
+
+		j.JoinResult = result
+	}
+
+	return j.JoinResult
+}
+
+func (j *JoinVisitor) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
+	switch t := n.(type) {
+	case *sql.JoinClause:
+		first, steps := flattenJoin(t)
+		j.steps = steps
+
+		sources := []sql.Source{first}
+		for _, step := range steps {
+			sources = append(sources, step.source)
+		}
+
+		for _, source := range sources {
+			var name string
+			switch s := source.(type) {
+			case *sql.QualifiedTableName:
+				name = s.TableName()
+			case *sql.ParenSource:
+				if _, ok := s.X.(*sql.SelectStatement); !ok {
+					return nil, nil, errors.New("duckql: unsupported join source: " + nodeString(source))
+				}
+
+				name = derivedTableName(s)
+			default:
+				return nil, nil, errors.New("duckql: unsupported join source: " + nodeString(source))
+			}
+
+			v, err := j.F.source(source)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			j.visitors = append(j.visitors, v)
+			j.names = append(j.names, name)
+		}
+
+		// The sources have been read, so there is nothing left to visit
+		return nil, n, nil
+	}
+
+	return j, n, nil
+}
+
+func (j *JoinVisitor) VisitEnd(n sql.Node) (sql.Node, error) {
+	return n, nil
+}
+
+// qualifyColumns returns a copy of a table read from a single source in
+// which every column is qualified with name, the name by which the source
+// is referred to, as the columns of a join are. Qualifying columns by alias
+// allows a table to appear in a join more than once.
+func qualifyColumns(table *IntermediateTable, name string) *IntermediateTable {
+	result := &IntermediateTable{
+		Aliases: make(map[string]string),
+		sqlizer: table.sqlizer,
+		now:     table.now,
+	}
+
+	for _, column := range table.Columns {
+		result.Columns = append(result.Columns, name+"."+column)
+	}
+
+	for _, row := range table.Rows {
+		result.Rows = append(result.Rows, qualifyRow(table, name, row))
+	}
+
+	return result
+}
+
+// qualifyRow qualifies the name of every value in a row of table with name.
+// A nil row stands for the row of NULLs used to pad unmatched rows of the
+// other side of an outer join.
+func qualifyRow(table *IntermediateTable, name string, row ResultRow) ResultRow {
+	r := make(ResultRow, len(table.Columns))
+	for idx, column := range table.Columns {
+		r[idx] = ResultValue{Name: name + "." + column, Value: null}
+		if row != nil {
+			r[idx].Value = row[idx].Value
+		}
+	}
+
+	return r
+}
+
+// usingPairs returns the indices of the columns of each side which USING or
+// NATURAL require to be equal. A NATURAL join uses every column name the
+// two sides have in common.
+func usingPairs(left *IntermediateTable, right *IntermediateTable, step joinStep) [][2]int {
+	var names []string
+	if using, ok := step.constraint.(*sql.UsingConstraint); ok {
+		for _, column := range using.Columns {
+			names = append(names, column.Name)
+		}
+	} else if step.operator.Natural.IsValid() {
+		for _, column := range right.Columns {
+			if left.identIndex(column) > -1 {
+				names = append(names, column)
+			}
+		}
+	}
+
+	var pairs [][2]int
+	for _, name := range names {
+		l, r := left.identIndex(name), right.identIndex(name)
+		if l == -1 || r == -1 {
+			raise("cannot join using column %s - column not present in both tables", name)
+		}
+
+		pairs = append(pairs, [2]int{l, r})
+	}
+
+	return pairs
+}
+
+// join joins right, referred to as name, onto left, keeping rows for which the constraint of the
+// join is true. Without a constraint every pair of rows matches, giving the
+// Cartesian product of the two sides. Unmatched rows are kept, padded with
+// NULLs, according to the type of the join.
+func (j *JoinVisitor) join(left *IntermediateTable, step joinStep, right *IntermediateTable, name string) *IntermediateTable {
+	result := &IntermediateTable{
+		Aliases:      make(map[string]string),
+		Columns:      append([]string{}, left.Columns...),
+		usingColumns: make(map[int]bool),
+		sqlizer:      j.F.s,
+		now:          j.F.now,
+		exec:         j.F,
+	}
+
+	for _, column := range right.Columns {
+		result.Columns = append(result.Columns, name+"."+column)
+	}
+
+	for idx := range left.usingColumns {
+		result.usingColumns[idx] = true
+	}
+
+	// The columns of the right side named by USING or NATURAL are omitted
+	// when '*' is expanded, since they are equal to those of the left side
+	pairs := usingPairs(left, right, step)
+	for _, pair := range pairs {
+		result.usingColumns[len(left.Columns)+pair[1]] = true
+	}
+
+	var on sql.Expr
+	if constraint, ok := step.constraint.(*sql.OnConstraint); ok {
+		on = constraint.X
+	}
+
+	leftPadding := make(ResultRow, len(left.Columns))
+	for idx, column := range left.Columns {
+		leftPadding[idx] = ResultValue{Name: column, Value: null}
+	}
+	rightPadding := qualifyRow(right, name, nil)
+
+	rightRows := make([]ResultRow, len(right.Rows))
+	for idx, r := range right.Rows {
+		rightRows[idx] = qualifyRow(right, name, r)
+	}
+
+	matches := func(row ResultRow) bool {
+		for _, pair := range pairs {
+			x, y := row[pair[0]].Value, row[len(left.Columns)+pair[1]].Value
+			x, y = applyComparisonAffinity(columnAffinity(x), columnAffinity(y), x, y)
+			if !x.IsValid() || !y.IsValid() || !valuesEqual(x, y) {
+				return false
+			}
+		}
+
+		return on == nil || isTrue(result.evaluate(on, row))
+	}
+
+	// When the constraint requires values from either side to be equal, the
+	// rows of the right side which may match a row of the left are found in
+	// a hash table of the right side, rather than by testing every pair of
+	// rows. Candidates are still tested against the whole constraint.
+	leftKeys, rightKeys := result.equalityKeys(len(left.Columns), pairs, on)
+
+	var buckets map[string][]int
+	if len(leftKeys) > 0 {
+		buckets = make(map[string][]int)
+		for idx, r := range rightRows {
+			if key, ok := hashKey(append(append(ResultRow{}, leftPadding...), r...), rightKeys); ok {
+				buckets[key] = append(buckets[key], idx)
+			}
+		}
+	}
+
+	every := make([]int, len(rightRows))
+	for idx := range every {
+		every[idx] = idx
+	}
+
+	typ := j.F.e.joinTypeOf(step.operator)
+	matched := make([]bool, len(right.Rows))
+
+	for _, l := range left.Rows {
+		j.F.e.checkContext()
+
+		candidates := every
+		if buckets != nil {
+			candidates = nil
+			if key, ok := hashKey(append(append(ResultRow{}, l...), rightPadding...), leftKeys); ok {
+				candidates = buckets[key]
+			}
+		}
+
+		found := false
+		for _, idx := range candidates {
+			row := append(append(ResultRow{}, l...), rightRows[idx]...)
+			if !matches(row) {
+				continue
+			}
+
+			found, matched[idx] = true, true
+			result.Rows = append(result.Rows, row)
+		}
+
+		if !found && (typ == leftJoin || typ == fullJoin) {
+			result.Rows = append(result.Rows, append(append(ResultRow{}, l...), rightPadding...))
+		}
+	}
+
+	if typ == rightJoin || typ == fullJoin {
+		for idx, r := range rightRows {
+			if !matched[idx] {
+				result.Rows = append(result.Rows, append(append(ResultRow{}, leftPadding...), r...))
+			}
+		}
+	}
+
+	return result
+}
+
+// joinKey computes, from a row of a join, the value of one side of an
+// equality between the two sides of the join
+type joinKey func(row ResultRow) reflect.Value
+
+// equalityKeys returns the values which a join's USING columns and the
+// equalities among the conjuncts of its ON expression require to be equal,
+// computed from the left and right sides of the join respectively. The
+// first leftColumns columns of the table belong to the left side.
+func (i *IntermediateTable) equalityKeys(leftColumns int, pairs [][2]int, on sql.Expr) (left, right []joinKey) {
+	for _, pair := range pairs {
+		l, r := pair[0], leftColumns+pair[1]
+		left = append(left, func(row ResultRow) reflect.Value { return row[l].Value })
+		right = append(right, func(row ResultRow) reflect.Value { return row[r].Value })
+	}
+
+	for _, conjunct := range conjuncts(on) {
+		b, ok := conjunct.(*sql.BinaryExpr)
+		if !ok || b.Op != sql.EQ {
+			continue
+		}
+
+		x, y := b.X, b.Y
+		switch {
+		case i.exprSide(leftColumns, x) < 0 && i.exprSide(leftColumns, y) > 0:
+		case i.exprSide(leftColumns, x) > 0 && i.exprSide(leftColumns, y) < 0:
+			x, y = y, x
+		default:
+			continue
+		}
+
+		left = append(left, func(row ResultRow) reflect.Value { return i.evaluate(x, row) })
+		right = append(right, func(row ResultRow) reflect.Value { return i.evaluate(y, row) })
+	}
+
+	return left, right
+}
+
+// conjuncts splits an expression into the terms which are combined by AND
+func conjuncts(expr sql.Expr) []sql.Expr {
+	switch t := expr.(type) {
+	case nil:
+		return nil
+	case *sql.ParenExpr:
+		return conjuncts(t.X)
+	case *sql.BinaryExpr:
+		if t.Op == sql.AND {
+			return append(conjuncts(t.X), conjuncts(t.Y)...)
+		}
+	}
+
+	return []sql.Expr{expr}
+}
+
+// sideFinder is a sql.Visitor which records which sides of a join the
+// columns referred to by an expression belong to
+type sideFinder struct {
+	table       *IntermediateTable
+	leftColumns int
+
+	left, right, other bool
+}
+
+func (f *sideFinder) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
+	idx := -1
+	switch t := n.(type) {
+	case *sql.Ident:
+		idx = f.table.identIndex(t.Name)
+	case *sql.QualifiedRef:
+		idx = f.table.refIndex(t)
+	case *sql.Type:
+		return nil, n, nil
+	case *sql.SelectStatement, sql.SelectExpr, *sql.Exists:
+		f.other = true
+		return nil, n, nil
+	case *sql.Call:
+		if f.table.sqlizer.isAggregateCall(t) {
+			f.other = true
+			return nil, n, nil
+		}
+
+		// The name of the function is not a column
+		for _, arg := range t.Args {
+			if _, err := sql.Walk(f, arg); err != nil {
+				return nil, nil, err
+			}
+		}
+		return nil, n, nil
+	default:
+		return f, n, nil
+	}
+
+	switch {
+	case idx == -1:
+		f.other = true
+	case idx < f.leftColumns:
+		f.left = true
+	default:
+		f.right = true
+	}
+
+	return nil, n, nil
+}
+
+func (f *sideFinder) VisitEnd(n sql.Node) (sql.Node, error) {
+	return n, nil
+}
+
+// exprSide returns -1 if every column expr refers to belongs to the left
+// side of a join, whose columns are the first leftColumns columns of the
+// table, or 1 if they all belong to the right side. It returns 0 when expr
+// refers to columns of both sides, to no columns at all, or contains an
+// aggregate or a subquery.
+func (i *IntermediateTable) exprSide(leftColumns int, expr sql.Expr) int {
+	f := sideFinder{table: i, leftColumns: leftColumns}
+	if _, err := sql.Walk(&f, expr); err != nil {
+		return 0
+	}
+
+	switch {
+	case f.other || f.left == f.right:
+		return 0
+	case f.left:
+		return -1
+	}
+	return 1
+}
+
+// hashKey computes the key under which a row of one side of a join is
+// hashed. Values which are equal always share a key, though values which
+// share a key need not be equal. ok is false if any key is NULL, since NULL
+// is never equal to anything. Since the affinity of the other side is not
+// known, text which spells a number shares the key of that number, which it
+// is equal to once a comparison has applied NUMERIC affinity to it, and a
+// number the key of its text, which it is equal to under TEXT affinity.
+func hashKey(row ResultRow, keys []joinKey) (key string, ok bool) {
+	var b strings.Builder
+	for _, k := range keys {
+		x := k(row)
+		if !x.IsValid() {
+			return "", false
+		}
+
+		// Text which is a date is equal to the time it describes
+		if x.Kind() == reflect.String {
+			if s := x.String(); len(s) >= 10 && s[4] == '-' {
+				if t, ok := parseTimeString(s, time.Time{}); ok {
+					x = reflect.ValueOf(t)
+				}
+			}
+		}
+		x = applyNumericAffinity(x)
+
+		b.WriteString(valueKey(x))
+		b.WriteByte(0)
+	}
+
+	return b.String(), true
+}
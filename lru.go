@@ -0,0 +1,81 @@
+package duckql
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lru holds up to size values by key, discarding the value which was used
+// least recently to make room for another. It is safe for concurrent use.
+type lru[K comparable, V any] struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[K]*list.Element
+}
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func newLRU[K comparable, V any](size int) *lru[K, V] {
+	return &lru[K, V]{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[K]*list.Element),
+	}
+}
+
+// get returns the value held under key, and whether there is one
+func (c *lru[K, V]) get(key K) (value V, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return value, false
+	}
+
+	c.order.MoveToFront(e)
+
+	return e.Value.(*lruEntry[K, V]).value, true
+}
+
+// put holds value under key, discarding the value which was used least
+// recently if the cache is full
+func (c *lru[K, V]) put(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.size <= 0 {
+		return
+	}
+
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*lruEntry[K, V]).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry[K, V]{key: key, value: value})
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[K, V]).key)
+	}
+}
+
+// clear discards every value
+func (c *lru[K, V]) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	clear(c.entries)
+}
@@ -0,0 +1,92 @@
+package duckql
+
+import (
+	"reflect"
+	"strings"
+)
+
+// null is the value of SQL NULL. It is the zero reflect.Value, so any value
+// for which IsValid() returns false is NULL.
+var null reflect.Value
+
+// isSQLNullType reports whether t is one of the database/sql Null types
+// (sql.NullString, sql.NullInt64, sql.Null[T] and so on), each of which
+// holds its value in the first field and its validity in the Valid field
+func isSQLNullType(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t.PkgPath() == "database/sql" &&
+		strings.HasPrefix(t.Name(), "Null") && t.NumField() == 2 && t.Field(1).Name == "Valid"
+}
+
+// nullableType returns the type of the value held by t if t is a nullable
+// Go type, that is a pointer or a database/sql Null type. Otherwise t is
+// returned unchanged and ok is false.
+func nullableType(t reflect.Type) (underlying reflect.Type, ok bool) {
+	switch {
+	case t.Kind() == reflect.Ptr:
+		return t.Elem(), true
+	case isSQLNullType(t):
+		return t.Field(0).Type, true
+	}
+
+	return t, false
+}
+
+// columnValue converts the value of a struct field into the value of its
+// column, unwrapping nullable fields into either their value or NULL
+func columnValue(v reflect.Value) reflect.Value {
+	switch {
+	case !v.IsValid():
+		return null
+	case v.Kind() == reflect.Ptr:
+		if v.IsNil() {
+			return null
+		}
+		return v.Elem()
+	case isSQLNullType(v.Type()):
+		if !v.Field(1).Bool() {
+			return null
+		}
+		return v.Field(0)
+	}
+
+	return v
+}
+
+// logicalAnd implements AND under SQL's three-valued logic, where a NULL
+// operand makes the result NULL unless the other operand is false
+func logicalAnd(x, y reflect.Value) reflect.Value {
+	if (x.IsValid() && !isTrue(x)) || (y.IsValid() && !isTrue(y)) {
+		return reflect.ValueOf(false)
+	}
+
+	if !x.IsValid() || !y.IsValid() {
+		return null
+	}
+
+	return reflect.ValueOf(true)
+}
+
+// logicalOr implements OR under SQL's three-valued logic, where a NULL
+// operand makes the result NULL unless the other operand is true
+func logicalOr(x, y reflect.Value) reflect.Value {
+	if (x.IsValid() && isTrue(x)) || (y.IsValid() && isTrue(y)) {
+		return reflect.ValueOf(true)
+	}
+
+	if !x.IsValid() || !y.IsValid() {
+		return null
+	}
+
+	return reflect.ValueOf(false)
+}
+
+// isDistinct implements the IS NOT operator, which unlike the comparison
+// operators treats NULL as a value: two NULLs are not distinct, and NULL is
+// distinct from every other value
+func isDistinct(x, y reflect.Value) bool {
+	if !x.IsValid() || !y.IsValid() {
+		return x.IsValid() != y.IsValid()
+	}
+
+	return !valuesEqual(x, y)
+}
@@ -0,0 +1,232 @@
+package duckql
+
+import (
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rqlite/sql"
+)
+
+// sourceRow is a row from which a result row is produced. Expressions are
+// evaluated against the row in table, which for an aggregate query is the
+// group the row stands for.
+type sourceRow struct {
+	table *IntermediateTable
+	row   ResultRow
+}
+
+func (w sourceRow) evaluate(n sql.Expr) reflect.Value {
+	return w.table.evaluate(n, w.row)
+}
+
+// orderKey is an ORDER BY term resolved against the statement. A term which
+// numbers a result column, or names one by its alias, takes its value from
+// the result row at index column. Any other term is an expression evaluated
+// against the source row.
+type orderKey struct {
+	column int
+	expr   sql.Expr
+}
+
+// orderKeys resolves the ORDER BY terms of the statement, whose rows are
+// read from source
+func (q *QueryExecutor) orderKeys(source *IntermediateTable) []orderKey {
+	var keys []orderKey
+
+	for idx, term := range q.order {
+		if n, ok := orderOrdinal(term.X); ok {
+			width := len(q.columnNames())
+			if n < 1 || n > int64(width) {
+				raise("%s ORDER BY term out of range - should be between 1 and %d", ordinal(idx+1), width)
+			}
+
+			keys = append(keys, orderKey{column: int(n - 1)})
+			continue
+		}
+
+		if ident, ok := term.X.(*sql.Ident); ok {
+			// As in SQLite, an alias takes precedence over a column of
+			// the same name
+			if position := q.aliasPosition(source, ident.Name); position > -1 {
+				keys = append(keys, orderKey{column: position})
+				continue
+			}
+		}
+
+		var f columnFinder
+		_, _ = sql.Walk(&f, term.X)
+		for _, ident := range f.idents {
+			if source.identIndex(ident.Name) < 0 {
+				if _, ok := q.resolveOuter(ident); !ok {
+					raise("no such column: %s", ident.Name)
+				}
+			}
+		}
+		for _, ref := range f.refs {
+			if ref.Column != nil && source.refIndex(ref) < 0 {
+				if _, ok := q.resolveOuter(ref); !ok {
+					raise("no such column: %s.%s", ref.Table.Name, ref.Column.Name)
+				}
+			}
+		}
+
+		keys = append(keys, orderKey{column: -1, expr: term.X})
+	}
+
+	return keys
+}
+
+// orderOrdinal returns the integer n of an ORDER BY term which is an
+// integer literal, optionally signed, and so numbers a result column
+func orderOrdinal(expr sql.Expr) (n int64, ok bool) {
+	sign := int64(1)
+	if t, ok := expr.(*sql.UnaryExpr); ok {
+		switch t.Op {
+		case sql.MINUS:
+			sign = -1
+		case sql.PLUS:
+		default:
+			return 0, false
+		}
+		expr = t.X
+	}
+
+	lit, ok := expr.(*sql.NumberLit)
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(lit.Value, 0, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return sign * n, true
+}
+
+// aliasPosition returns the index in a result row of the value of the
+// result column aliased as name, or -1 if no result column is
+func (q *QueryExecutor) aliasPosition(source *IntermediateTable, name string) int {
+	padding := make(ResultRow, len(source.Columns))
+
+	position := 0
+	for _, column := range q.resultColumns {
+		if column.Alias != nil && column.Alias.Name == name {
+			return position
+		}
+
+		switch t := column.Expr.(type) {
+		case *sql.QualifiedRef:
+			if t.Star.Line != 0 {
+				position += len(source.expandStar(t.Table.Name, padding))
+				continue
+			}
+		case nil:
+			if column.Star.Line > 0 {
+				position += len(source.expandStar("", padding))
+				continue
+			}
+		}
+
+		position++
+	}
+
+	return -1
+}
+
+// orderValues returns the value of each of keys for the result row
+// result, which was produced from row
+func orderValues(keys []orderKey, row sourceRow, result ResultRow) []reflect.Value {
+	values := make([]reflect.Value, len(keys))
+	for idx, key := range keys {
+		if key.column > -1 {
+			values[idx] = result[key.column].Value
+		} else {
+			values[idx] = row.evaluate(key.expr)
+		}
+	}
+
+	return values
+}
+
+// sortRows sorts rows by the values of the ORDER BY terms for each row,
+// held in keys. Rows which are equal under the terms keep their order.
+func sortRows(rows ResultRows, keys [][]reflect.Value, terms []*sql.OrderingTerm) ResultRows {
+	if len(terms) == 0 {
+		return rows
+	}
+
+	indexes := make([]int, len(rows))
+	for idx := range indexes {
+		indexes[idx] = idx
+	}
+
+	slices.SortStableFunc(indexes, func(a, b int) int {
+		return compareOrdering(terms, keys[a], keys[b])
+	})
+
+	sorted := make(ResultRows, len(rows))
+	for idx, index := range indexes {
+		sorted[idx] = rows[index]
+	}
+
+	return sorted
+}
+
+// compareOrdering compares the values of ORDER BY terms for two rows. NULL
+// sorts first unless the term is descending or says NULLS LAST.
+func compareOrdering(terms []*sql.OrderingTerm, x, y []reflect.Value) int {
+	for idx, term := range terms {
+		a, b := x[idx], y[idx]
+
+		c := compareCollated(term.Collation, a, b)
+		if term.Desc.IsValid() {
+			c = -c
+		}
+
+		nullsFirst := !term.Desc.IsValid()
+		if term.NullsFirst.IsValid() || term.NullsLast.IsValid() {
+			nullsFirst = term.NullsFirst.IsValid()
+		}
+
+		switch {
+		case !a.IsValid() && !b.IsValid():
+			c = 0
+		case !a.IsValid() && nullsFirst, !b.IsValid() && !nullsFirst:
+			c = -1
+		case !a.IsValid(), !b.IsValid():
+			c = 1
+		}
+
+		if c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+// collations holds the collating sequences SQLite provides, by which text
+// may be compared
+var collations = []string{"binary", "nocase", "rtrim"}
+
+// compareCollated orders two values as compareValues does, comparing text
+// under the collating sequence given by collation. NOCASE ignores the case
+// of ASCII letters, and RTRIM ignores trailing spaces.
+func compareCollated(collation *sql.CollationClause, x, y reflect.Value) int {
+	if collation == nil || x.Kind() != reflect.String || y.Kind() != reflect.String {
+		return compareValues(x, y)
+	}
+
+	a, b := x.String(), y.String()
+	switch strings.ToLower(collation.Name.Name) {
+	case "nocase":
+		a, b = lowerFunction([]reflect.Value{x}).String(), lowerFunction([]reflect.Value{y}).String()
+	case "rtrim":
+		a, b = strings.TrimRight(a, " "), strings.TrimRight(b, " ")
+	}
+
+	return strings.Compare(a, b)
+}
@@ -0,0 +1,191 @@
+package duckql
+
+import (
+	"regexp"
+	"unicode/utf8"
+)
+
+// patternElement is a single compiled element of a LIKE or GLOB pattern
+type patternElement struct {
+	kind   int
+	r      rune
+	ranges [][2]rune
+	negate bool
+}
+
+const (
+	patternLiteral = iota
+	patternAnyOne
+	patternAnyMany
+	patternClass
+)
+
+// compileLike compiles a SQL LIKE pattern, where '%' matches any sequence of
+// characters and '_' matches exactly one. If escape is not utf8.RuneError,
+// the character following it is always matched literally.
+func compileLike(pattern string, escape rune) []patternElement {
+	var elements []patternElement
+
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case escape != utf8.RuneError && r == escape && i+1 < len(runes):
+			i++
+			elements = append(elements, patternElement{kind: patternLiteral, r: runes[i]})
+		case r == '%':
+			elements = append(elements, patternElement{kind: patternAnyMany})
+		case r == '_':
+			elements = append(elements, patternElement{kind: patternAnyOne})
+		default:
+			elements = append(elements, patternElement{kind: patternLiteral, r: r})
+		}
+	}
+
+	return elements
+}
+
+// compileGlob compiles a GLOB pattern, which follows Unix filename globbing:
+// '*' matches any sequence, '?' matches one character and '[...]' matches a
+// character class, negated with a leading '^'.
+func compileGlob(pattern string) []patternElement {
+	var elements []patternElement
+
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch r {
+		case '*':
+			elements = append(elements, patternElement{kind: patternAnyMany})
+		case '?':
+			elements = append(elements, patternElement{kind: patternAnyOne})
+		case '[':
+			class := patternElement{kind: patternClass}
+
+			j := i + 1
+			if j < len(runes) && runes[j] == '^' {
+				class.negate = true
+				j++
+			}
+
+			// A ']' immediately after the opening bracket is a literal
+			start := j
+			for ; j < len(runes) && (runes[j] != ']' || j == start); j++ {
+				lo, hi := runes[j], runes[j]
+				if j+2 < len(runes) && runes[j+1] == '-' && runes[j+2] != ']' {
+					hi = runes[j+2]
+					j += 2
+				}
+				class.ranges = append(class.ranges, [2]rune{lo, hi})
+			}
+
+			// An unterminated class can never match, just as in SQLite
+			if j >= len(runes) {
+				return []patternElement{{kind: patternClass}}
+			}
+
+			i = j
+			elements = append(elements, class)
+		default:
+			elements = append(elements, patternElement{kind: patternLiteral, r: r})
+		}
+	}
+
+	return elements
+}
+
+func foldASCII(r rune) rune {
+	if r >= 'A' && r <= 'Z' {
+		return r + ('a' - 'A')
+	}
+	return r
+}
+
+func (e *patternElement) matches(r rune, fold bool) bool {
+	switch e.kind {
+	case patternAnyOne:
+		return true
+	case patternLiteral:
+		if fold {
+			return foldASCII(e.r) == foldASCII(r)
+		}
+		return e.r == r
+	case patternClass:
+		for _, rng := range e.ranges {
+			if r >= rng[0] && r <= rng[1] {
+				return !e.negate
+			}
+		}
+		return e.negate
+	}
+
+	return false
+}
+
+// matchPattern reports whether the entirety of s matches the compiled
+// pattern. fold enables ASCII case-insensitive matching of literals.
+func matchPattern(elements []patternElement, s string, fold bool) bool {
+	runes := []rune(s)
+
+	p, i := 0, 0
+	star, mark := -1, 0
+
+	for i < len(runes) {
+		switch {
+		case p < len(elements) && elements[p].kind == patternAnyMany:
+			star, mark = p, i
+			p++
+		case p < len(elements) && elements[p].matches(runes[i], fold):
+			p++
+			i++
+		case star > -1:
+			// Backtrack, letting the last wildcard absorb one more character
+			p = star + 1
+			mark++
+			i = mark
+		default:
+			return false
+		}
+	}
+
+	for p < len(elements) && elements[p].kind == patternAnyMany {
+		p++
+	}
+
+	return p == len(elements)
+}
+
+// matchLike implements the SQL LIKE operator with SQLite semantics
+func matchLike(pattern, s string, escape rune) bool {
+	return matchPattern(compileLike(pattern, escape), s, true)
+}
+
+// matchGlob implements the SQL GLOB operator with SQLite semantics
+func matchGlob(pattern, s string) bool {
+	return matchPattern(compileGlob(pattern), s, false)
+}
+
+// regexpCacheSize is the number of compiled REGEXP patterns which are kept,
+// so that a pattern is not compiled again for every row it is matched
+// against
+const regexpCacheSize = 64
+
+var regexpCache = newLRU[string, *regexp.Regexp](regexpCacheSize)
+
+// matchRegexp implements the REGEXP operator, reporting whether s contains a
+// match of the regular expression pattern
+func matchRegexp(pattern, s string) (bool, error) {
+	if re, ok := regexpCache.get(pattern); ok {
+		return re.MatchString(s), nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+	regexpCache.put(pattern, re)
+
+	return re.MatchString(s), nil
+}
@@ -0,0 +1,247 @@
+package duckql
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// printfFunction implements printf(format, ...) and format(format, ...),
+// which substitute their arguments into format as SQLite's printf() does.
+// An argument which is missing is taken to be NULL, and the result is NULL
+// if format is.
+func printfFunction(args []reflect.Value) reflect.Value {
+	if !args[0].IsValid() {
+		return null
+	}
+
+	format := coerceToString(args[0])
+	rest := args[1:]
+	next := func() reflect.Value {
+		if len(rest) == 0 {
+			return null
+		}
+		arg := rest[0]
+		rest = rest[1:]
+		return arg
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+
+		spec, end := parseFormatSpec(format, i+1, next)
+		if end >= len(format) {
+			b.WriteByte('%')
+			break
+		}
+		i = end
+
+		if !spec.format(&b, format[end], next) {
+			break
+		}
+	}
+
+	return reflect.ValueOf(b.String())
+}
+
+// formatSpec is a conversion specification of printf(), other than the
+// conversion itself. width and precision are -1 when they are not given.
+type formatSpec struct {
+	flags     string
+	comma     bool
+	width     int
+	precision int
+}
+
+// parseFormatSpec parses the flags, width and precision of a conversion
+// specification starting at format[i], returning them along with the index
+// of the conversion character. A width or precision of * is taken from the
+// next argument.
+func parseFormatSpec(format string, i int, next func() reflect.Value) (formatSpec, int) {
+	spec := formatSpec{width: -1, precision: -1}
+
+	for ; i < len(format); i++ {
+		switch c := format[i]; c {
+		case '-', '+', ' ', '0', '#':
+			spec.flags += string(c)
+			continue
+		case ',':
+			spec.comma = true
+			continue
+		case '!':
+			continue
+		}
+		break
+	}
+
+	if i < len(format) && format[i] == '*' {
+		spec.width = int(toInteger(next()))
+		if spec.width < 0 {
+			spec.flags += "-"
+			spec.width = -spec.width
+		}
+		i++
+	} else {
+		i, spec.width = formatNumber(format, i, spec.width)
+	}
+
+	if i < len(format) && format[i] == '.' {
+		i++
+		if i < len(format) && format[i] == '*' {
+			spec.precision = max(int(toInteger(next())), 0)
+			i++
+		} else {
+			i, spec.precision = formatNumber(format, i, 0)
+		}
+	}
+
+	return spec, i
+}
+
+// formatNumber parses the digits of format starting at i, returning the
+// index following them and their value, or otherwise if there are none
+func formatNumber(format string, i int, otherwise int) (int, int) {
+	start := i
+	for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+		i++
+	}
+
+	if i == start {
+		return i, otherwise
+	}
+
+	n, err := strconv.Atoi(format[start:i])
+	if err != nil {
+		raise("printf() width or precision too large")
+	}
+
+	return i, n
+}
+
+// verb returns the Go format verb for the conversion c with the spec's
+// flags, width and precision
+func (s formatSpec) verb(c byte, flags string) string {
+	v := "%" + flags
+	if s.width >= 0 {
+		v += strconv.Itoa(s.width)
+	}
+	if s.precision >= 0 {
+		v += "." + strconv.Itoa(s.precision)
+	}
+
+	return v + string(c)
+}
+
+// pad pads text with spaces to the spec's width
+func (s formatSpec) pad(text string) string {
+	n := s.width - utf8.RuneCountInString(text)
+	if n <= 0 {
+		return text
+	}
+
+	if strings.Contains(s.flags, "-") {
+		return text + strings.Repeat(" ", n)
+	}
+
+	return strings.Repeat(" ", n) + text
+}
+
+// format writes the conversion c of the spec to b, taking any argument it
+// needs from next. It returns false if c is not a conversion printf()
+// knows, in which case the rest of the format is left out.
+func (s formatSpec) format(b *strings.Builder, c byte, next func() reflect.Value) bool {
+	switch c {
+	case '%':
+		b.WriteByte('%')
+	case 'd', 'i':
+		n := toInteger(next())
+		if s.comma {
+			b.WriteString(s.pad(commaSeparated(n, strings.Contains(s.flags, "+"))))
+			break
+		}
+		fmt.Fprintf(b, s.verb('d', s.flags), n)
+	case 'u':
+		fmt.Fprintf(b, s.verb('d', s.flags), uint64(toInteger(next())))
+	case 'x', 'X', 'o':
+		fmt.Fprintf(b, s.verb(c, s.flags), uint64(toInteger(next())))
+	case 'f', 'e', 'E', 'g', 'G':
+		// C's conversions, unlike Go's %g, have a precision of 6 by default
+		if s.precision < 0 {
+			s.precision = 6
+		}
+		fmt.Fprintf(b, s.verb(c, s.flags), toNumeric(next()).float())
+	case 'c':
+		arg := next()
+		var r string
+		if arg.IsValid() {
+			if text := coerceToString(arg); text != "" {
+				_, size := utf8.DecodeRuneInString(text)
+				r = text[:size]
+			}
+		}
+		count := max(s.precision, 1)
+		s.precision = -1
+		b.WriteString(s.pad(strings.Repeat(r, count)))
+	case 's', 'z':
+		arg := next()
+		var text string
+		if arg.IsValid() {
+			text = coerceToString(arg)
+		}
+		fmt.Fprintf(b, s.verb('s', strings.ReplaceAll(s.flags, "0", "")), text)
+	case 'q', 'Q', 'w':
+		arg := next()
+		quote := "'"
+		if c == 'w' {
+			quote = `"`
+		}
+
+		var text string
+		switch {
+		case !arg.IsValid() && c == 'Q':
+			text = "NULL"
+		case !arg.IsValid():
+			text = "(NULL)"
+		default:
+			text = strings.ReplaceAll(coerceToString(arg), quote, quote+quote)
+			if c == 'Q' {
+				text = quote + text + quote
+			}
+		}
+		fmt.Fprintf(b, s.verb('s', strings.ReplaceAll(s.flags, "0", "")), text)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// commaSeparated returns the decimal digits of n with a comma between each
+// group of three
+func commaSeparated(n int64, plus bool) string {
+	digits := strconv.FormatUint(uint64(n), 10)
+	sign := ""
+	switch {
+	case n < 0:
+		digits = strconv.FormatUint(uint64(-(n+1))+1, 10)
+		sign = "-"
+	case plus:
+		sign = "+"
+	}
+
+	var b strings.Builder
+	for idx, d := range digits {
+		if idx > 0 && (len(digits)-idx)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(d)
+	}
+
+	return sign + b.String()
+}
@@ -40,6 +40,14 @@ func (r *RESTBacking) Rows() ResultRows {
 	return r.exec.Rows()
 }
 
+func (r *RESTBacking) RowsWithError() (ResultRows, error) {
+	return r.exec.RowsWithError()
+}
+
+func (r *RESTBacking) execute(n sql.Node, e *execution) (ResultRows, error) {
+	return NewQueryExecutor(r.s, r.FillIntermediate).run(n, e)
+}
+
 func (r *RESTBacking) FillIntermediate(intermediate *IntermediateTable) {
 	if intermediate == nil {
 		return
@@ -54,18 +62,27 @@ func (r *RESTBacking) FillIntermediate(intermediate *IntermediateTable) {
 		return
 	}
 
-	req, err := http.NewRequest(routeToCall.method, routeToCall.options.Url, nil)
+	e := intermediate.execution()
+
+	req, err := http.NewRequestWithContext(e.context(), routeToCall.method, routeToCall.options.Url, nil)
+	if err != nil {
+		panic(evaluationError{err})
+	}
 
 	req.Header = routeToCall.options.Header
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return
+		// A request given up on because the statement was cancelled
+		// fails with the context's error rather than the client's
+		e.checkContext()
+		panic(evaluationError{err})
 	}
 
 	data, err := routeToCall.handler(resp)
 	if err != nil {
-		return
+		e.checkContext()
+		panic(evaluationError{err})
 	}
 
 	for _, column := range intermediate.Source.Columns {
@@ -85,20 +102,7 @@ func (r *RESTBacking) FillIntermediate(intermediate *IntermediateTable) {
 		}
 
 		for i := 0; i < v.Len(); i++ {
-			var result ResultRow
-
-			for _, column := range intermediate.Columns {
-				var val reflect.Value
-				switch v.Index(i).Kind() {
-				case reflect.Ptr:
-					val = v.Index(i).Elem().FieldByName(intermediate.Source.ColumnMappings[column].GoField)
-				case reflect.Struct:
-					val = v.Index(i).FieldByName(intermediate.Source.ColumnMappings[column].GoField)
-				}
-				result = append(result, ResultValue{Name: column, Value: val})
-			}
-
-			intermediate.Rows = append(intermediate.Rows, result)
+			intermediate.Rows = append(intermediate.Rows, intermediate.Source.rowFor(v.Index(i)))
 		}
 	}
 }
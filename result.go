@@ -29,6 +29,8 @@ func (r *ResultRow) String() string {
 			s.WriteString("|")
 		}
 		switch v.Value.Kind() {
+		case reflect.Invalid:
+			// NULL is rendered as an empty string, as in the sqlite3 shell
 		case reflect.Bool:
 			var b int
 			if v.Value.Bool() {
@@ -58,3 +60,8 @@ type ResultValue struct {
 	Name  string
 	Value reflect.Value
 }
+
+// IsNull reports whether the value is SQL NULL
+func (v ResultValue) IsNull() bool {
+	return !v.Value.IsValid()
+}
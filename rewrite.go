@@ -0,0 +1,387 @@
+package duckql
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/rqlite/sql"
+)
+
+// statementToken is a token of a statement, along with the offset (in runes)
+// at which it starts
+type statementToken struct {
+	tok   sql.Token
+	lit   string
+	start int
+}
+
+func scanStatement(statement string) []statementToken {
+	var tokens []statementToken
+
+	scanner := sql.NewScanner(strings.NewReader(statement))
+	for {
+		pos, tok, lit := scanner.Scan()
+		if tok == sql.EOF || tok == sql.ILLEGAL {
+			break
+		}
+
+		tokens = append(tokens, statementToken{tok: tok, lit: lit, start: pos.Offset})
+	}
+
+	return tokens
+}
+
+// statementEdit replaces the runes of a statement between start and end
+type statementEdit struct {
+	start, end int
+	text       string
+}
+
+func applyEdits(statement string, edits []statementEdit) string {
+	if len(edits) == 0 {
+		return statement
+	}
+
+	sort.SliceStable(edits, func(i, j int) bool {
+		return edits[i].start < edits[j].start
+	})
+
+	runes := []rune(statement)
+
+	var rewritten strings.Builder
+	last := 0
+	for _, edit := range edits {
+		rewritten.WriteString(string(runes[last:edit.start]))
+		rewritten.WriteString(edit.text)
+		last = edit.end
+	}
+	rewritten.WriteString(string(runes[last:]))
+
+	return rewritten.String()
+}
+
+// rewriteStatement works around constructs which the parser either does not
+// support or parses incorrectly, by rewriting the text of the statement into
+// an equivalent form before it is parsed
+func rewriteStatement(statement string) string {
+	statement = rewriteDistinctFrom(statement)
+	statement = rewriteBetween(statement)
+
+	return statement
+}
+
+// rewriteJoins rewrites RIGHT and FULL joins, which the parser does not
+// support, into LEFT joins. The type of each rewritten join is returned
+// keyed by the offset of its LEFT keyword in the rewritten statement, from
+// which rewrittenJoins finds the joins once the statement is parsed. It
+// must be the last rewrite applied to a statement.
+func rewriteJoins(statement string) (string, map[int]joinType) {
+	upper := strings.ToUpper(statement)
+	if !strings.Contains(upper, "RIGHT") && !strings.Contains(upper, "FULL") {
+		return statement, nil
+	}
+
+	tokens := scanStatement(statement)
+
+	var edits []statementEdit
+	joins := make(map[int]joinType)
+
+	// shift is the difference the keywords rewritten so far have made to
+	// the offsets of the tokens which follow them
+	shift := 0
+	for i, token := range tokens {
+		var typ joinType
+		switch {
+		case token.tok != sql.IDENT:
+			continue
+		case strings.EqualFold(token.lit, "RIGHT"):
+			typ = rightJoin
+		case strings.EqualFold(token.lit, "FULL"):
+			typ = fullJoin
+		default:
+			continue
+		}
+
+		next := i + 1
+		if next < len(tokens) && tokens[next].tok == sql.OUTER {
+			next++
+		}
+		if next >= len(tokens) || tokens[next].tok != sql.JOIN {
+			continue
+		}
+
+		edits = append(edits, statementEdit{start: token.start, end: token.start + len(token.lit), text: "LEFT"})
+		joins[token.start+shift] = typ
+		shift += len("LEFT") - len(token.lit)
+	}
+
+	return applyEdits(statement, edits), joins
+}
+
+// rewrittenJoins returns the type of each join of n which rewriteJoins
+// rewrote into a LEFT join, given the offsets of their LEFT keywords which
+// it returned
+func rewrittenJoins(n sql.Node, offsets map[int]joinType) map[*sql.JoinOperator]joinType {
+	if len(offsets) == 0 {
+		return nil
+	}
+
+	joins := make(map[*sql.JoinOperator]joinType)
+	for _, op := range collectNodes[*sql.JoinOperator](n) {
+		if !op.Left.IsValid() {
+			continue
+		}
+
+		if typ, ok := offsets[op.Left.Offset]; ok {
+			joins[op] = typ
+		}
+	}
+
+	return joins
+}
+
+// restoreJoins renders n as text, reversing rewriteJoins so that a
+// database which supports RIGHT and FULL joins is handed the joins the
+// statement asked for rather than the LEFT joins they were parsed as
+func restoreJoins(n sql.Node, e *execution) string {
+	statement := nodeString(n)
+	if e == nil || len(e.joins) == 0 {
+		return statement
+	}
+
+	var operators []*sql.JoinOperator
+	for _, op := range collectNodes[*sql.JoinOperator](n) {
+		if op.Left.IsValid() {
+			operators = append(operators, op)
+		}
+	}
+
+	sort.Slice(operators, func(i, j int) bool {
+		return operators[i].Left.Offset < operators[j].Left.Offset
+	})
+
+	// Each operator is rendered where it appeared in the statement, so the
+	// LEFT keywords of the rendered statement belong to the operators in
+	// the order of their offsets
+	tokens := scanStatement(statement)
+
+	var edits []statementEdit
+	for _, token := range tokens {
+		if token.tok != sql.LEFT || len(operators) == 0 {
+			continue
+		}
+
+		op := operators[0]
+		operators = operators[1:]
+
+		switch e.joinTypeOf(op) {
+		case rightJoin:
+			edits = append(edits, statementEdit{start: token.start, end: token.start + len(token.lit), text: "RIGHT"})
+		case fullJoin:
+			edits = append(edits, statementEdit{start: token.start, end: token.start + len(token.lit), text: "FULL"})
+		}
+	}
+
+	return applyEdits(statement, edits)
+}
+
+// escapeExpr is the ESCAPE clause of a LIKE expression, which
+// sql.BinaryExpr cannot render as text
+type escapeExpr struct {
+	*sql.BinaryExpr
+}
+
+func (e escapeExpr) String() string {
+	return e.X.String() + " ESCAPE " + e.Y.String()
+}
+
+// nodeString renders n as text, as n.String() does. sql.BinaryExpr panics
+// when rendering an ESCAPE clause, and sql.SelectStatement renders
+// "LIMIT x, y" as "LIMIT x OFFSET y", swapping the limit and the offset, so
+// a node which has either is rendered from a copy in which each ESCAPE
+// clause is replaced by an escapeExpr and each such LIMIT is written with
+// OFFSET.
+func nodeString(n sql.Node) string {
+	rewrite := false
+	_, _ = walkAll(sql.VisitFunc(func(n sql.Node) (sql.Node, error) {
+		switch t := n.(type) {
+		case *sql.BinaryExpr:
+			rewrite = rewrite || t.Op == sql.ESCAPE
+		case *sql.SelectStatement:
+			rewrite = rewrite || t.OffsetComma.IsValid()
+		}
+		return n, nil
+	}), n)
+
+	if !rewrite {
+		return n.String()
+	}
+
+	switch t := n.(type) {
+	case sql.Statement:
+		n = cloneStatement(t)
+	case sql.Expr:
+		n = sql.CloneExpr(t)
+	case sql.Source:
+		n = sql.CloneSource(t)
+	}
+
+	n, _ = walkAll(sql.VisitEndFunc(func(n sql.Node) (sql.Node, error) {
+		switch t := n.(type) {
+		case *sql.BinaryExpr:
+			if t.Op == sql.ESCAPE {
+				return escapeExpr{t}, nil
+			}
+		case *sql.SelectStatement:
+			if t.OffsetComma.IsValid() {
+				t.LimitExpr, t.OffsetExpr = t.OffsetExpr, t.LimitExpr
+				t.Offset, t.OffsetComma = t.OffsetComma, sql.Pos{}
+			}
+		}
+		return n, nil
+	}), n)
+
+	return n.String()
+}
+
+// rewriteDistinctFrom rewrites "IS [NOT] DISTINCT FROM", which the parser
+// does not support, into the equivalent "IS NOT" and "IS" operators
+func rewriteDistinctFrom(statement string) string {
+	if !strings.Contains(strings.ToUpper(statement), "DISTINCT") {
+		return statement
+	}
+
+	tokens := scanStatement(statement)
+
+	var edits []statementEdit
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i].tok != sql.IS {
+			continue
+		}
+
+		j, replacement := i+1, "IS NOT"
+		if j < len(tokens) && tokens[j].tok == sql.NOT {
+			j, replacement = j+1, "IS"
+		}
+
+		if j+1 >= len(tokens) || tokens[j].tok != sql.DISTINCT || tokens[j+1].tok != sql.FROM {
+			continue
+		}
+
+		edits = append(edits, statementEdit{
+			start: tokens[i].start,
+			end:   tokens[j+1].start + len([]rune(tokens[j+1].lit)),
+			text:  replacement,
+		})
+		i = j + 1
+	}
+
+	return applyEdits(statement, edits)
+}
+
+// rewriteBetween parenthesizes "x BETWEEN y AND z" when it is followed by an
+// operator which binds no more tightly than BETWEEN, such as AND, OR, = or
+// IS. The parser reads everything after BETWEEN which binds more tightly
+// than OR as the range, so "x BETWEEN 1 AND 5 AND y = 2" would otherwise be
+// evaluated as "x BETWEEN (1 AND 5) AND (y = 2)", "x BETWEEN 1 AND 5 = 1" as
+// "x BETWEEN 1 AND (5 = 1)", and a following OR is rejected.
+func rewriteBetween(statement string) string {
+	if !strings.Contains(strings.ToUpper(statement), "BETWEEN") {
+		return statement
+	}
+
+	tokens := scanStatement(statement)
+
+	var edits []statementEdit
+	for i, token := range tokens {
+		if token.tok != sql.BETWEEN {
+			continue
+		}
+
+		op := i
+		if op > 0 && tokens[op-1].tok == sql.NOT {
+			op--
+		}
+
+		and := operandEnd(tokens, i+1)
+		if and >= len(tokens) || tokens[and].tok != sql.AND {
+			continue
+		}
+
+		end := operandEnd(tokens, and+1)
+		if end >= len(tokens) || tokens[end].tok.Precedence() == sql.LowestPrec || tokens[end].tok.Precedence() > sql.BETWEEN.Precedence() {
+			continue
+		}
+
+		start := operandStart(tokens, op-1)
+		if start >= op {
+			continue
+		}
+
+		edits = append(edits,
+			statementEdit{start: tokens[start].start, end: tokens[start].start, text: "("},
+			statementEdit{start: tokens[end].start, end: tokens[end].start, text: ")"},
+		)
+	}
+
+	return applyEdits(statement, edits)
+}
+
+// isOperandToken reports whether the token at index i may appear, outside of
+// parentheses, in an operand of BETWEEN
+func isOperandToken(tokens []statementToken, i int) bool {
+	switch tok := tokens[i].tok; tok {
+	case sql.DOT, sql.CAST, sql.COLLATE, sql.EXISTS, sql.ROWID,
+		sql.CURRENT_DATE, sql.CURRENT_TIME, sql.CURRENT_TIMESTAMP:
+		return true
+	case sql.REPLACE, sql.LIKE, sql.GLOB, sql.IF:
+		// Keywords which are also the names of functions
+		return i+1 < len(tokens) && tokens[i+1].tok == sql.LP
+	default:
+		return tok.IsLiteral() || tok.Precedence() >= sql.GT.Precedence()
+	}
+}
+
+// operandEnd returns the index of the first token at or after i which is not
+// part of the operand starting at i
+func operandEnd(tokens []statementToken, i int) int {
+	depth := 0
+	for ; i < len(tokens); i++ {
+		switch tok := tokens[i].tok; {
+		case tok == sql.LP || tok == sql.CASE:
+			depth++
+		case tok == sql.RP || tok == sql.END:
+			if depth == 0 {
+				return i
+			}
+			depth--
+		case depth > 0:
+		case !isOperandToken(tokens, i):
+			return i
+		}
+	}
+
+	return i
+}
+
+// operandStart returns the index of the first token of the operand ending
+// with the token at index i
+func operandStart(tokens []statementToken, i int) int {
+	depth := 0
+	for ; i >= 0; i-- {
+		switch tok := tokens[i].tok; {
+		case tok == sql.RP || tok == sql.END:
+			depth++
+		case tok == sql.LP || tok == sql.CASE:
+			if depth == 0 {
+				return i + 1
+			}
+			depth--
+		case depth > 0:
+		case !isOperandToken(tokens, i):
+			return i + 1
+		}
+	}
+
+	return 0
+}
@@ -1,10 +1,10 @@
 package duckql
 
 import (
+	"context"
 	"fmt"
 	"github.com/rqlite/sql"
 	"google.golang.org/api/sheets/v4"
-	"log"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -41,9 +41,17 @@ func (s *SheetsBacking) Rows() ResultRows {
 	return s.exec.Rows()
 }
 
-func (s *SheetsBacking) getNonEmptyRowCount() (int, error) {
+func (s *SheetsBacking) RowsWithError() (ResultRows, error) {
+	return s.exec.RowsWithError()
+}
+
+func (s *SheetsBacking) execute(n sql.Node, e *execution) (ResultRows, error) {
+	return NewQueryExecutor(s.s, s.FillIntermediate).run(n, e)
+}
+
+func (s *SheetsBacking) getNonEmptyRowCount(ctx context.Context) (int, error) {
 	readRange := fmt.Sprintf("%s%d:%s", s.options.IDColumn, s.options.DataRowStart, s.options.IDColumn)
-	resp, err := s.options.Service.Spreadsheets.Values.Get(s.options.SheetId, readRange).Do()
+	resp, err := s.options.Service.Spreadsheets.Values.Get(s.options.SheetId, readRange).Context(ctx).Do()
 	if err != nil {
 		return 0, err
 	}
@@ -132,9 +140,14 @@ func (s *SheetsBacking) FillIntermediate(intermediate *IntermediateTable) {
 		}
 	}
 
-	numRows, err := s.getNonEmptyRowCount()
+	e := intermediate.execution()
+
+	numRows, err := s.getNonEmptyRowCount(e.context())
 	if err != nil {
-		panic(err)
+		// A request which failed because the statement was cancelled
+		// gives the statement's error
+		e.checkContext()
+		panic(evaluationError{err})
 	}
 
 	if numRows == 0 {
@@ -147,9 +160,10 @@ func (s *SheetsBacking) FillIntermediate(intermediate *IntermediateTable) {
 	readRange := s.ComputeRangeString(colStart, rowStart, colEnd, rowEnd)
 	colStartIndex := SheetColumnToIndex(colStart)
 
-	resp, err := s.options.Service.Spreadsheets.Values.Get(s.options.SheetId, readRange).Do()
+	resp, err := s.options.Service.Spreadsheets.Values.Get(s.options.SheetId, readRange).Context(e.context()).Do()
 	if err != nil {
-		log.Fatalf("Unable to retrieve data from sheet: %v", err)
+		e.checkContext()
+		panic(evaluationError{fmt.Errorf("duckql: unable to retrieve data from sheet: %w", err)})
 	}
 
 	for _, column := range intermediate.Source.Columns {
@@ -166,9 +180,20 @@ func (s *SheetsBacking) FillIntermediate(intermediate *IntermediateTable) {
 
 			index := absoluteIndex - colStartIndex
 
-			var cellValue reflect.Value
+			var cell string
 			if index < len(row) {
-				cellValue = coerceSpreadsheetValue(row[index].(string), mapping.Type)
+				cell = row[index].(string)
+			}
+
+			var cellValue reflect.Value
+			if mapping.Nullable {
+				// Empty cells of nullable columns are NULL
+				if cell != "" {
+					underlying, _ := nullableType(mapping.Type)
+					cellValue = coerceSpreadsheetValue(cell, underlying)
+				}
+			} else if index < len(row) {
+				cellValue = coerceSpreadsheetValue(cell, mapping.Type)
 			} else {
 				cellValue = reflect.ValueOf("")
 			}
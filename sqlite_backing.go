@@ -1,9 +1,11 @@
 package duckql
 
 import (
+	"context"
 	gosql "database/sql"
 	"reflect"
 	"strconv"
+	"sync"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/rqlite/sql"
@@ -14,6 +16,15 @@ type SQLiteBacking struct {
 	db           *gosql.DB
 	lastError    error
 	rawStatement string
+
+	// mu guards lastError, which each execution sets
+	mu sync.Mutex
+
+	// e is the execution the statement is rendered for
+	e *execution
+
+	// depth is the number of statements enclosing the one being visited
+	depth int
 }
 
 // New creates a new SQLiteBacking with the given SQLite database connection
@@ -26,23 +37,33 @@ func NewSQLiteBacking(db *gosql.DB, s *SQLizer) *SQLiteBacking {
 
 // Visit implements sql.Visitor
 func (s *SQLiteBacking) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
+	if err := walkNested(s, n); err != nil {
+		return nil, nil, err
+	}
+
 	switch t := n.(type) {
 	case *sql.InsertStatement, *sql.DeleteStatement, *sql.UpdateStatement:
-		s.rawStatement = t.String()
+		s.rawStatement = restoreJoins(t, s.e)
 	case *sql.SelectStatement:
+		s.depth++
+
 		// Rewrite the AST to expand '*'
 		// This allows intentionally hidden fields to stay hidden
 
 		var rewritten []*sql.ResultColumn
 		for _, column := range t.Columns {
 			if column.Star.Line > 0 {
-				src, err := strconv.Unquote(t.Source.String())
+				// '*' is left as it is when selecting from anything
+				// other than a single table, such as a subquery
+				src, err := strconv.Unquote(nodeString(t.Source))
 				if err != nil {
+					rewritten = append(rewritten, column)
 					continue
 				}
 
 				source, ok := s.sqlizer.Tables[src]
 				if !ok {
+					rewritten = append(rewritten, column)
 					continue
 				}
 
@@ -63,8 +84,6 @@ func (s *SQLiteBacking) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
 
 		t.Columns = rewritten
 
-		s.rawStatement = t.String()
-
 		return s, t, nil
 	}
 
@@ -73,17 +92,58 @@ func (s *SQLiteBacking) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
 
 // VisitEnd implements sql.Visitor
 func (s *SQLiteBacking) VisitEnd(n sql.Node) (sql.Node, error) {
+	if t, ok := n.(*sql.SelectStatement); ok {
+		s.depth--
+
+		// The statement is rendered once '*' has been expanded in its
+		// subqueries as well
+		if s.depth == 0 {
+			s.rawStatement = restoreJoins(t, s.e)
+		}
+	}
+
 	return n, nil
 }
 
-// Rows implements duckql.BackingStore
+// Rows implements duckql.BackingStore. Any error is kept, and returned by
+// Error.
 func (s *SQLiteBacking) Rows() ResultRows {
+	rows, _ := s.RowsWithError()
+	return rows
+}
+
+// RowsWithError implements duckql.RowsWithError
+func (s *SQLiteBacking) RowsWithError() (ResultRows, error) {
+	return s.query(context.Background(), nil)
+}
+
+// execute renders n with a backing of its own, and queries the database
+// with it under the context and arguments of e
+func (s *SQLiteBacking) execute(n sql.Node, e *execution) (ResultRows, error) {
+	b := NewSQLiteBacking(s.db, s.sqlizer)
+	b.e = e
+
+	if _, err := sql.Walk(b, n); err != nil {
+		return nil, err
+	}
+
+	rows, err := b.query(e.context(), e.args)
+
+	s.mu.Lock()
+	s.lastError = b.lastError
+	s.mu.Unlock()
+
+	return rows, err
+}
+
+// query runs the rendered statement, binding args to its parameters
+func (s *SQLiteBacking) query(ctx context.Context, args []any) (ResultRows, error) {
 	var results ResultRows
 	if s.rawStatement != "" {
-		rows, err := s.db.Query(s.rawStatement)
+		rows, err := s.db.QueryContext(ctx, s.rawStatement, args...)
 		if err != nil {
 			s.lastError = err
-			return nil
+			return nil, err
 		}
 		defer rows.Close()
 
@@ -91,7 +151,7 @@ func (s *SQLiteBacking) Rows() ResultRows {
 		columns, err := rows.Columns()
 		if err != nil {
 			s.lastError = err
-			return nil
+			return nil, err
 		}
 
 		// Prepare values holder
@@ -106,20 +166,14 @@ func (s *SQLiteBacking) Rows() ResultRows {
 			err = rows.Scan(scanArgs...)
 			if err != nil {
 				s.lastError = err
-				return nil
+				return nil, err
 			}
 
 			resultRow := make(ResultRow, len(columns))
 			for i, col := range columns {
-				var val reflect.Value
-				if values[i] == nil {
-					val = reflect.Zero(reflect.TypeOf(&gosql.NullString{}))
-				} else {
-					val = reflect.ValueOf(values[i])
-				}
 				resultRow[i] = ResultValue{
 					Name:  col,
-					Value: val,
+					Value: reflect.ValueOf(values[i]),
 				}
 			}
 			results = append(results, resultRow)
@@ -127,13 +181,16 @@ func (s *SQLiteBacking) Rows() ResultRows {
 
 		if err = rows.Err(); err != nil {
 			s.lastError = err
-			return nil
+			return nil, err
 		}
 	}
-	return results
+	return results, nil
 }
 
 // Error returns the last error encountered during query execution
 func (s *SQLiteBacking) Error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	return s.lastError
 }
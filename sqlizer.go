@@ -2,9 +2,13 @@ package duckql
 
 import (
 	"cmp"
+	"context"
+	"errors"
 	"reflect"
 	"slices"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
 
 	"github.com/rqlite/sql"
@@ -15,6 +19,13 @@ type BackingStore interface {
 	Rows() ResultRows
 }
 
+// RowsWithError is implemented by a BackingStore which can report why the
+// rows of a statement could not be read. Its RowsWithError method is called
+// in place of Rows, and the error it returns is returned by Execute.
+type RowsWithError interface {
+	RowsWithError() (ResultRows, error)
+}
+
 type ColumnMapping struct {
 	Name       string
 	GoField    string
@@ -22,6 +33,7 @@ type ColumnMapping struct {
 	SQLComment string
 	Tag        reflect.StructTag
 	Type       reflect.Type
+	Nullable   bool
 }
 
 const (
@@ -31,10 +43,23 @@ const (
 	AllowDeleteStatements
 )
 
+// SQLizer validates and executes statements against its tables. Once it
+// has been set up, it and the Stmts it prepares may be used by several
+// goroutines at once, though methods which change it, such as
+// SetPermissions and RegisterFunction, must not be called while statements
+// are being executed.
 type SQLizer struct {
 	Tables      map[string]*Table
 	Permissions uint
 	Backing     BackingStore
+	Clock       func() time.Time
+
+	functions map[string]*registeredFunction
+
+	// statements holds the statements prepared most recently, and mu
+	// guards it
+	statements *lru[string, *Stmt]
+	mu         sync.Mutex
 }
 
 func (s *SQLizer) SetPermissions(permissions uint) {
@@ -45,7 +70,121 @@ func (s *SQLizer) SetBacking(backing BackingStore) {
 	s.Backing = backing
 }
 
+// SetClock sets the function used to find the current time, which is the
+// meaning of 'now' in the date and time functions. It defaults to time.Now,
+// and is not used by backings which hand queries to a database.
+func (s *SQLizer) SetClock(clock func() time.Time) {
+	s.Clock = clock
+}
+
+// RegisterFunction makes the scalar function f available to queries under
+// name, taking precedence over any built-in function of the same name. f is
+// passed exactly arity arguments, or any number if arity is -1, and its
+// result should be of the SQL type returnType, which is shown along with the
+// function in DDL().
+func (s *SQLizer) RegisterFunction(name string, arity int, returnType string, f ScalarFunction) error {
+	if f == nil {
+		return errors.New("duckql: function " + name + " is nil")
+	}
+
+	return s.register(&registeredFunction{
+		name:       name,
+		arity:      arity,
+		returnType: returnType,
+		scalar:     f,
+	})
+}
+
+// RegisterAggregate makes the aggregate function f available to queries
+// under name, in the same way as RegisterFunction. f is called with a row
+// for each row in the group, holding the values of the arguments, and the
+// first value of the first row it returns is the result.
+func (s *SQLizer) RegisterAggregate(name string, arity int, returnType string, f AggregateFunction) error {
+	if f == nil {
+		return errors.New("duckql: aggregate " + name + " is nil")
+	}
+
+	return s.register(&registeredFunction{
+		name:       name,
+		arity:      arity,
+		returnType: returnType,
+		aggregate: func(call *sql.Call) Accumulator {
+			return newRowsAccumulator(call, f)
+		},
+	})
+}
+
+// RegisterAccumulator makes an aggregate function available to queries
+// under name, in the same way as RegisterAggregate, but computes its result
+// one row at a time. init is called for each group to make the Accumulator
+// which computes the result for that group.
+func (s *SQLizer) RegisterAccumulator(name string, arity int, returnType string, init func() Accumulator) error {
+	if init == nil {
+		return errors.New("duckql: aggregate " + name + " is nil")
+	}
+
+	return s.register(&registeredFunction{
+		name:       name,
+		arity:      arity,
+		returnType: returnType,
+		aggregate: func(*sql.Call) Accumulator {
+			return init()
+		},
+	})
+}
+
+func (s *SQLizer) register(f *registeredFunction) error {
+	if !isBareIdent(f.name) {
+		return errors.New("duckql: invalid function name '" + f.name + "'")
+	}
+
+	if f.arity < -1 {
+		return errors.New("duckql: invalid arity for function " + f.name)
+	}
+
+	if s.functions == nil {
+		s.functions = make(map[string]*registeredFunction)
+	}
+
+	f.name = strings.ToLower(f.name)
+	s.functions[f.name] = f
+
+	// Prepared statements were validated without the function
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statements.clear()
+
+	return nil
+}
+
+// Now returns the current time according to the SQLizer's clock
+func (s *SQLizer) Now() time.Time {
+	if s.Clock != nil {
+		return s.Clock()
+	}
+
+	return time.Now()
+}
+
 func (s *SQLizer) Execute(statement string) (ResultRows, error) {
+	return s.ExecuteArgs(statement)
+}
+
+// ExecuteArgs executes statement in the same way as Execute, binding args
+// to its parameters. A parameter is written as "?", "?NNN", ":name",
+// "@name" or "$name", and a named parameter may be given a value by passing
+// a database/sql.NamedArg. Parameters are bound as values, never as text of
+// the statement, and are handed to backings which query a database as
+// arguments of the query.
+func (s *SQLizer) ExecuteArgs(statement string, args ...any) (ResultRows, error) {
+	return s.ExecuteContext(context.Background(), statement, args...)
+}
+
+// ExecuteContext executes statement in the same way as ExecuteArgs, giving
+// up once ctx is cancelled or its deadline passes, in which case the error
+// of ctx is returned. The context is handed to the backing, which uses it
+// for any requests it makes while reading tables.
+func (s *SQLizer) ExecuteContext(ctx context.Context, statement string, args ...any) (ResultRows, error) {
 	// Support a small subset of dot commands
 	switch statement {
 	case ".schema":
@@ -59,28 +198,12 @@ func (s *SQLizer) Execute(statement string) (ResultRows, error) {
 		}, nil
 	}
 
-	parser := sql.NewParser(strings.NewReader(statement))
-	stmt, err := parser.ParseStatement()
+	stmt, err := s.Prepare(statement)
 	if err != nil {
 		return nil, err
 	}
 
-	v := &Validator{s: s}
-	n, err := sql.Walk(v, stmt)
-	if err != nil {
-		return nil, err
-	}
-
-	if s.Backing != nil {
-		_, err = sql.Walk(s.Backing, n)
-		if err != nil {
-			return nil, err
-		}
-
-		return s.Backing.Rows(), nil
-	}
-
-	return nil, nil
+	return stmt.QueryContext(ctx, args...)
 }
 
 func (s *SQLizer) TypeForData(data any) reflect.Type {
@@ -146,7 +269,8 @@ func (s *SQLizer) addStructTable(str any) {
 		field := t.Field(i)
 
 		columnName := toSnakeCase(field.Name)
-		columnType := sqliteTypeForGoType(field.Type)
+		underlyingType, nullable := nullableType(field.Type)
+		columnType := sqliteTypeForGoType(underlyingType)
 		columnComment := ""
 
 		if columnType == "unknown" {
@@ -180,6 +304,7 @@ func (s *SQLizer) addStructTable(str any) {
 			SQLComment: columnComment,
 			Tag:        field.Tag,
 			Type:       field.Type,
+			Nullable:   nullable,
 		}
 	}
 
@@ -251,6 +376,20 @@ func (s *SQLizer) DDL() string {
 		sql.WriteString(")\n\n")
 	}
 
+	if len(s.functions) > 0 {
+		var names []string
+		for name := range s.functions {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+
+		for _, name := range names {
+			sql.WriteString("-- " + s.functions[name].signature() + "\n")
+		}
+
+		sql.WriteString("\n")
+	}
+
 	return sql.String()
 }
 
@@ -0,0 +1,283 @@
+package duckql
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rqlite/sql"
+)
+
+// defaultStatementCacheSize is the number of prepared statements a SQLizer
+// keeps unless told otherwise by SetStatementCacheSize
+const defaultStatementCacheSize = 128
+
+// Stmt is a statement which has been parsed and validated, and may be
+// executed any number of times with different arguments, including by
+// several goroutines at once.
+type Stmt struct {
+	s *SQLizer
+
+	// statement is the text of the statement as it was parsed, after
+	// rewriting, and n the statement parsed from it
+	statement string
+	n         sql.Node
+
+	// joins holds the types of the RIGHT and FULL joins of the statement,
+	// which are parsed as LEFT joins
+	joins map[*sql.JoinOperator]joinType
+
+	params     []parameter
+	paramCount int
+
+	// permissions are those under which the statement was validated
+	permissions uint
+
+	// mu guards the statement, which is written to as it is walked, while
+	// it is validated again or copied for an execution
+	mu sync.Mutex
+}
+
+// Prepare parses and validates statement, returning a Stmt which executes
+// it. The SQLizer keeps the statements it has prepared most recently, and
+// returns the same Stmt for a statement which differs from one of those
+// only in its whitespace, comments or the case of its keywords.
+func (s *SQLizer) Prepare(statement string) (*Stmt, error) {
+	key, cacheable := normalizeStatement(statement)
+	if cacheable {
+		if stmt, ok := s.statementCache().get(key); ok {
+			return stmt, nil
+		}
+	}
+
+	stmt := &Stmt{s: s}
+
+	var joins map[int]joinType
+	stmt.statement, joins = rewriteJoins(rewriteStatement(statement))
+
+	var err error
+	stmt.params, stmt.paramCount, err = parameters(stmt.statement)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := sql.NewParser(strings.NewReader(stmt.statement))
+	parsed, err := parser.ParseStatement()
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := walkAll(sql.VisitEndFunc(reassociate), parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt.n, err = walkAll(sql.VisitEndFunc(liftNot), n)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt.joins = rewrittenJoins(stmt.n, joins)
+
+	if err := stmt.validate(); err != nil {
+		return nil, err
+	}
+
+	if cacheable {
+		s.statementCache().put(key, stmt)
+	}
+
+	return stmt, nil
+}
+
+// validate checks the statement against the SQLizer's tables and
+// permissions
+func (stmt *Stmt) validate() error {
+	v := &Validator{s: stmt.s}
+	if _, err := sql.Walk(v, stmt.n); err != nil {
+		return err
+	}
+
+	stmt.permissions = stmt.s.Permissions
+
+	return nil
+}
+
+// Query executes the statement, binding args to its parameters as
+// ExecuteArgs does
+func (stmt *Stmt) Query(args ...any) (ResultRows, error) {
+	return stmt.QueryContext(context.Background(), args...)
+}
+
+// QueryContext executes the statement as Query does, giving up once ctx is
+// cancelled or its deadline passes as ExecuteContext does
+func (stmt *Stmt) QueryContext(ctx context.Context, args ...any) (rows ResultRows, err error) {
+	s := stmt.s
+
+	n, joins, err := stmt.copyForExecution()
+	if err != nil {
+		return nil, err
+	}
+
+	bindings, err := bindParameters(stmt.params, stmt.paramCount, args)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &execution{ctx: ctx, args: args, bindings: bindings, joins: joins}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if s.Backing == nil {
+		return nil, nil
+	}
+
+	// Tables may be filled while the statement is walked, so an error
+	// raised while filling one, or its context being cancelled, is
+	// recovered here as well as by Rows
+	defer recoverEvaluation(&err)
+
+	if backing, ok := s.Backing.(executor); ok {
+		return backing.execute(n, e)
+	}
+
+	if _, err := sql.Walk(s.Backing, n); err != nil {
+		return nil, err
+	}
+
+	if backing, ok := s.Backing.(RowsWithError); ok {
+		return backing.RowsWithError()
+	}
+
+	return s.Backing.Rows(), nil
+}
+
+// copyForExecution returns a copy of the statement for a single execution,
+// along with the types of the copy's joins, first validating the statement
+// again if the permissions have changed since it was validated. Walking a
+// statement writes to it, so each execution walks a copy of its own.
+func (stmt *Stmt) copyForExecution() (sql.Node, map[*sql.JoinOperator]joinType, error) {
+	stmt.mu.Lock()
+	defer stmt.mu.Unlock()
+
+	if stmt.permissions != stmt.s.Permissions {
+		if err := stmt.validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	n := cloneStatement(stmt.n)
+	if len(stmt.joins) == 0 {
+		return n, nil, nil
+	}
+
+	// The operators of the copy are found in the same order as those of
+	// the statement
+	operators, copied := collectNodes[*sql.JoinOperator](stmt.n), collectNodes[*sql.JoinOperator](n)
+
+	joins := make(map[*sql.JoinOperator]joinType)
+	for i, op := range operators {
+		if typ, ok := stmt.joins[op]; ok {
+			joins[copied[i]] = typ
+		}
+	}
+
+	return n, joins, nil
+}
+
+// execution is the state of a single execution of a statement, which is
+// handed to the backing along with the statement: the context it runs under,
+// the arguments given for its parameters and their values by the offset at
+// which each appears in the statement, and the types of its joins
+type execution struct {
+	ctx      context.Context
+	args     []any
+	bindings map[int]reflect.Value
+	joins    map[*sql.JoinOperator]joinType
+}
+
+// executor is implemented by the backings of this package, which are
+// handed the execution of each statement they run
+type executor interface {
+	execute(n sql.Node, e *execution) (ResultRows, error)
+}
+
+// context returns the context of the execution, or the background context
+// for a statement which is not being executed by a Stmt
+func (e *execution) context() context.Context {
+	if e == nil || e.ctx == nil {
+		return context.Background()
+	}
+
+	return e.ctx
+}
+
+// checkContext raises the error of the context of the execution once it
+// has been cancelled or its deadline has passed. It is called as rows are
+// read, so that a statement over many rows can be abandoned.
+func (e *execution) checkContext() {
+	if err := e.context().Err(); err != nil {
+		panic(evaluationError{err})
+	}
+}
+
+// String returns the text of the statement
+func (stmt *Stmt) String() string {
+	return stmt.statement
+}
+
+// SetStatementCacheSize sets the number of prepared statements the SQLizer
+// keeps, discarding those it has. A size of 0 keeps none.
+func (s *SQLizer) SetStatementCacheSize(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.statements = newLRU[string, *Stmt](size)
+}
+
+// statementCache returns the statements prepared most recently, by their
+// normalized text
+func (s *SQLizer) statementCache() *lru[string, *Stmt] {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.statements == nil {
+		s.statements = newLRU[string, *Stmt](defaultStatementCacheSize)
+	}
+
+	return s.statements
+}
+
+// normalizeStatement returns the tokens of statement as text, without the
+// whitespace and comments between them or a trailing semicolon, so that
+// statements which would be parsed the same way are normalized the same
+// way. A statement which cannot be scanned is not normalized, and ok is
+// false.
+func normalizeStatement(statement string) (key string, ok bool) {
+	var tokens []string
+
+	scanner := sql.NewScanner(strings.NewReader(statement))
+	for {
+		_, tok, lit := scanner.Scan()
+		switch {
+		case tok == sql.EOF:
+			for len(tokens) > 0 && tokens[len(tokens)-1] == sql.SEMI.String() {
+				tokens = tokens[:len(tokens)-1]
+			}
+			return strings.Join(tokens, " "), true
+		case tok == sql.ILLEGAL:
+			return "", false
+		case tok == sql.COMMENT:
+		case tok.IsLiteral():
+			// Keywords may be written in any case, but the text of a
+			// literal is kept exactly
+			tokens = append(tokens, tok.String()+strconv.Quote(lit))
+		default:
+			tokens = append(tokens, tok.String())
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package duckql
+
+import (
+	"reflect"
+
+	"github.com/rqlite/sql"
+)
+
+// outerRow is the row of an enclosing statement for which a subquery is
+// executed. A correlated subquery refers to the columns of this row.
+type outerRow struct {
+	table *IntermediateTable
+	row   ResultRow
+
+	// referenced records whether the subquery referred to the row, in
+	// which case its result cannot be reused for other rows
+	referenced bool
+}
+
+// resolve evaluates a column reference which the subquery's own tables do
+// not have against the row, or against the rows of the statements
+// enclosing it in turn. ok is false if no enclosing statement has the
+// column.
+func (o *outerRow) resolve(n sql.Expr) (v reflect.Value, ok bool) {
+	idx := -1
+	switch t := n.(type) {
+	case *sql.Ident:
+		idx = o.table.identIndex(t.Name)
+	case *sql.QualifiedRef:
+		idx = o.table.refIndex(t)
+	}
+
+	if idx > -1 {
+		o.referenced = true
+		return o.table.evaluate(n, o.row), true
+	}
+
+	if o.table.exec == nil {
+		return null, false
+	}
+
+	v, ok = o.table.exec.resolveOuter(n)
+	o.referenced = o.referenced || ok
+
+	return v, ok
+}
+
+// root returns the executor of the outermost statement
+func (q *QueryExecutor) root() *QueryExecutor {
+	for q.parent != nil {
+		q = q.parent
+	}
+
+	return q
+}
+
+// child returns an executor for a subquery of the statement, run for the
+// row outer of it, or for no particular row if outer is nil
+func (q *QueryExecutor) child(outer *outerRow) *QueryExecutor {
+	return &QueryExecutor{
+		FillIntermediate: q.FillIntermediate,
+		s:                q.s,
+		now:              q.now,
+		e:                q.e,
+		parent:           q,
+		outer:            outer,
+	}
+}
+
+// resolveOuter evaluates a column reference which the statement's own
+// tables do not have against the row of the nearest enclosing statement
+// for which a subquery is being run
+func (q *QueryExecutor) resolveOuter(n sql.Expr) (reflect.Value, bool) {
+	for ; q != nil; q = q.parent {
+		if q.outer != nil {
+			return q.outer.resolve(n)
+		}
+	}
+
+	return null, false
+}
+
+// subquery executes a subquery of the statement for the row outer. The
+// result of a subquery which does not refer to any enclosing statement is
+// the same for every row, and so is kept for the rest of the statement.
+func (q *QueryExecutor) subquery(s *sql.SelectStatement, outer *outerRow) ResultRows {
+	root := q.root()
+	if r, ok := root.results[s]; ok {
+		return r
+	}
+
+	sub := q.child(outer)
+	if err := sub.prepare(s); err != nil {
+		panic(evaluationError{err})
+	}
+
+	r := sub.rows()
+	if !outer.referenced && root.results != nil {
+		root.results[s] = r
+	}
+
+	return r
+}
+
+// table executes the statement, returning its result as a table whose
+// columns are named as the result columns are
+func (q *QueryExecutor) table(name string) *IntermediateTable {
+	rows := q.rows()
+	columns := q.columnNames()
+
+	table := NewIntermediateTable()
+	table.Source = &Table{Name: name, Columns: columns}
+	table.Columns = columns
+	table.Rows = rows
+
+	return table
+}
+
+// columnNames returns the names of the statement's result columns, which
+// are found from the statement rather than its rows since there may be no
+// rows
+func (q *QueryExecutor) columnNames() []string {
+	if len(q.parts) > 0 {
+		return q.parts[0].columnNames()
+	}
+
+	source := q.intermediate.Result()
+	padding := make(ResultRow, len(source.Columns))
+
+	var columns []string
+	for _, column := range q.resultColumns {
+		switch t := column.Expr.(type) {
+		case *sql.QualifiedRef:
+			if t.Star.Line != 0 {
+				for _, v := range source.expandStar(t.Table.Name, padding) {
+					columns = append(columns, v.Name)
+				}
+				continue
+			}
+		case nil:
+			if column.Star.Line > 0 {
+				for _, v := range source.expandStar("", padding) {
+					columns = append(columns, v.Name)
+				}
+				continue
+			}
+		}
+
+		columns = append(columns, columnName(column))
+	}
+
+	return columns
+}
+
+// SubqueryVisitor reads a derived table, the result of a subquery used as
+// a source. The table is described by a Table of its own, named by the
+// subquery's alias.
+type SubqueryVisitor struct {
+	F     *QueryExecutor
+	Table *IntermediateTable
+
+	exec *QueryExecutor
+	name string
+}
+
+func (v *SubqueryVisitor) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
+	if t, ok := n.(*sql.ParenSource); ok {
+		v.name = derivedTableName(t)
+		v.exec = v.F.child(nil)
+		if err := v.exec.prepare(t.X.(*sql.SelectStatement)); err != nil {
+			return nil, nil, err
+		}
+
+		// The subquery has been prepared, so there is nothing left to
+		// visit
+		return nil, n, nil
+	}
+
+	return v, n, nil
+}
+
+// derivedTableName returns the name by which the derived table of source is
+// referred to, which is its alias. A subquery without an alias cannot be
+// referred to by name.
+func derivedTableName(source *sql.ParenSource) string {
+	if source.Alias != nil {
+		return source.Alias.Name
+	}
+
+	return "(subquery)"
+}
+
+func (v *SubqueryVisitor) VisitEnd(n sql.Node) (sql.Node, error) {
+	return n, nil
+}
+
+// Result executes the subquery the first time it is called. Like the
+// joining of tables, this happens while the statement is executed.
+func (v *SubqueryVisitor) Result() *IntermediateTable {
+	if v.Table == nil && v.exec != nil {
+		v.Table = v.exec.table(v.name)
+	}
+
+	return v.Table
+}
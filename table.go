@@ -1,11 +1,13 @@
 package duckql
 
 import (
+	"cmp"
+	"fmt"
 	"reflect"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/rqlite/sql"
 )
@@ -18,11 +20,68 @@ type Table struct {
 	ForeignKeys    map[string]*Table
 }
 
+// evaluationError is raised via panic when an expression cannot be
+// evaluated, and is recovered into an ordinary error by recoverEvaluation
+type evaluationError struct {
+	err error
+}
+
+func raise(format string, args ...any) {
+	panic(evaluationError{fmt.Errorf("duckql: "+format, args...)})
+}
+
+// recoverEvaluation is deferred by callers of the evaluator to turn a raised
+// evaluationError into the returned error
+func recoverEvaluation(err *error) {
+	if x := recover(); x != nil {
+		e, ok := x.(evaluationError)
+		if !ok {
+			panic(x)
+		}
+		*err = e.err
+	}
+}
+
+// rowFor maps the fields of v, a struct or pointer to a struct of the type
+// backing the table, into a row of the table's columns
+func (t *Table) rowFor(v reflect.Value) ResultRow {
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	var result ResultRow
+	for _, column := range t.Columns {
+		result = append(result, ResultValue{Name: column, Value: columnValue(v.FieldByName(t.ColumnMappings[column].GoField))})
+	}
+
+	return result
+}
+
 type IntermediateTable struct {
 	Source  *Table
 	Aliases map[string]string
 	Columns []string
 	Rows    ResultRows
+
+	// sqlizer is the SQLizer executing the statement, whose registered
+	// functions are available to expressions
+	sqlizer *SQLizer
+
+	// now is the time at which the statement began, used as the value of
+	// 'now' by the date and time functions
+	now time.Time
+
+	// usingColumns holds the indices of the columns of the right side of
+	// USING and NATURAL joins, which are omitted when '*' is expanded
+	usingColumns map[int]bool
+
+	// exec is the executor of the statement the table belongs to, which
+	// runs the subqueries of its expressions
+	exec *QueryExecutor
+
+	// windows holds the index at which the value of each window function
+	// is found in a row, past the row's columns
+	windows map[*sql.Call]int
 }
 
 func coerceToInt(x reflect.Value) *int64 {
@@ -32,7 +91,7 @@ func coerceToInt(x reflect.Value) *int64 {
 		i = x.Int()
 
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		i = x.Int()
+		i = int64(x.Uint())
 
 	case reflect.Bool:
 		if x.Bool() {
@@ -52,116 +111,772 @@ func coerceToInt(x reflect.Value) *int64 {
 	return &i
 }
 
+// coerceToString converts x to its textual representation, as SQLite does
+// when a non-text value is used where text is expected
+func coerceToString(x reflect.Value) string {
+	switch x.Kind() {
+	case reflect.String:
+		return x.String()
+	case reflect.Float32, reflect.Float64:
+		f := x.Float()
+		if f == float64(int64(f)) {
+			return strconv.FormatFloat(f, 'f', 1, 64)
+		}
+		return strconv.FormatFloat(f, 'g', 15, 64)
+	}
+
+	if i := coerceToInt(x); i != nil {
+		return strconv.FormatInt(*i, 10)
+	}
+
+	if x.IsValid() && x.CanInterface() {
+		return fmt.Sprintf("%v", x.Interface())
+	}
+
+	return ""
+}
+
+func coerceToFloat(x reflect.Value) *float64 {
+	var f float64
+	switch x.Kind() {
+	case reflect.Float32, reflect.Float64:
+		f = x.Float()
+	default:
+		i := coerceToInt(x)
+		if i == nil {
+			return nil
+		}
+		f = float64(*i)
+	}
+
+	return &f
+}
+
+// compareNumeric compares two values numerically, comparing as integers
+// where possible and falling back to floating point. ok is false when
+// either value is not numeric.
+func compareNumeric(x, y reflect.Value) (c int, ok bool) {
+	if xI, yI := coerceToInt(x), coerceToInt(y); xI != nil && yI != nil {
+		return cmp.Compare(*xI, *yI), true
+	}
+
+	if xF, yF := coerceToFloat(x), coerceToFloat(y); xF != nil && yF != nil {
+		return cmp.Compare(*xF, *yF), true
+	}
+
+	return 0, false
+}
+
+// storageClass ranks a value by the SQLite storage class it would have,
+// which is the first thing by which SQLite orders values. The operands of a
+// comparison are ranked once comparisonOperands has applied affinity to
+// them, so that text compared with a numeric column, including the result
+// of an arithmetic or || expression, is ranked as the number it spells.
+func storageClass(x reflect.Value) int {
+	switch {
+	case !x.IsValid():
+		return 0
+	case x.Kind() == reflect.String:
+		return 2
+	case coerceToFloat(x) != nil:
+		return 1
+	}
+
+	return 3
+}
+
+// compareValues orders two values as SQLite does: NULL first, then numbers
+// by value, then text by its bytes, and then anything else
+func compareValues(x, y reflect.Value) int {
+	cx, cy := storageClass(x), storageClass(y)
+	if cx != cy {
+		return cmp.Compare(cx, cy)
+	}
+
+	switch cx {
+	case 0:
+		return 0
+	case 1:
+		c, _ := compareNumeric(x, y)
+		return c
+	case 2:
+		return strings.Compare(x.String(), y.String())
+	}
+
+	return strings.Compare(coerceToString(x), coerceToString(y))
+}
+
+// valuesEqual reports whether two non-NULL values are equal, comparing
+// numbers by value regardless of their Go type
+func valuesEqual(x, y reflect.Value) bool {
+	x, y = coerceTimeOperands(x, y)
+
+	if c, ok := compareNumeric(x, y); ok {
+		return c == 0
+	}
+
+	return reflect.DeepEqual(x.Interface(), y.Interface())
+}
+
+// affinity returns the affinity SQLite gives the expression n, whose value
+// is v, as an operand of a comparison. A column reference has that of its
+// column, which follows from the type of its value, a scalar subquery that
+// of its first result column, and a CAST that of the type it converts to.
+// Any other expression has none, and "" is returned.
+func affinity(n sql.Expr, v reflect.Value) string {
+	switch t := n.(type) {
+	case *sql.ParenExpr:
+		return affinity(t.X, v)
+	case *sql.CastExpr:
+		return typeAffinity(t.Type.Name.Name)
+	case sql.SelectExpr:
+		if len(t.Columns) > 0 {
+			return affinity(t.Columns[0].Expr, v)
+		}
+	case *sql.Ident, *sql.QualifiedRef:
+		return columnAffinity(v)
+	}
+
+	return ""
+}
+
+// columnAffinity returns the affinity of a column whose value is v, which
+// follows from the type of the value
+func columnAffinity(v reflect.Value) string {
+	if !v.IsValid() {
+		return ""
+	}
+
+	if columnType := sqliteTypeForGoType(v.Type()); columnType != "unknown" {
+		return typeAffinity(columnType)
+	}
+
+	return "BLOB"
+}
+
+// isNumericAffinity reports whether affinity is INTEGER, REAL or NUMERIC
+func isNumericAffinity(affinity string) bool {
+	return affinity == "INTEGER" || affinity == "REAL" || affinity == "NUMERIC"
+}
+
+// comparisonOperands applies affinity to the values x and y of the operands
+// a and b of a comparison, as SQLite does before comparing them. If one
+// operand has numeric affinity and the other does not, NUMERIC affinity is
+// applied to the other, and if one has TEXT affinity and the other has none,
+// TEXT affinity is applied to the other. Either operand may be nil, for a
+// value which has no affinity.
+func comparisonOperands(a, b sql.Expr, x, y reflect.Value) (reflect.Value, reflect.Value) {
+	return applyComparisonAffinity(affinity(a, x), affinity(b, y), x, y)
+}
+
+// applyComparisonAffinity applies affinity to the values x and y of two
+// operands whose affinities are ax and ay, as comparisonOperands does
+func applyComparisonAffinity(ax, ay string, x, y reflect.Value) (reflect.Value, reflect.Value) {
+	switch {
+	case isNumericAffinity(ax) && !isNumericAffinity(ay):
+		y = applyNumericAffinity(y)
+	case isNumericAffinity(ay) && !isNumericAffinity(ax):
+		x = applyNumericAffinity(x)
+	case ax == "TEXT" && ay == "":
+		y = applyTextAffinity(y)
+	case ay == "TEXT" && ax == "":
+		x = applyTextAffinity(x)
+	}
+
+	return x, y
+}
+
+// evaluateComparison applies one of the ordering operators <, <=, > and >=
+// to x and y
+func evaluateComparison(op sql.Token, x, y reflect.Value) reflect.Value {
+	if !x.IsValid() || !y.IsValid() {
+		return null
+	}
+
+	x, y = coerceTimeOperands(x, y)
+
+	// Values which are not both numbers, such as text, are ordered as
+	// SQLite orders them
+	c, ok := compareNumeric(x, y)
+	if !ok {
+		c = compareValues(x, y)
+	}
+
+	switch op {
+	case sql.GT:
+		return reflect.ValueOf(c > 0)
+	case sql.GE:
+		return reflect.ValueOf(c >= 0)
+	case sql.LT:
+		return reflect.ValueOf(c < 0)
+	default:
+		return reflect.ValueOf(c <= 0)
+	}
+}
+
+// valueKey returns a string which is equal for any two values SQLite would
+// consider equal, suitable for use as a map key when grouping rows
+func valueKey(x reflect.Value) string {
+	if !x.IsValid() {
+		return "null"
+	}
+
+	if x.Kind() == reflect.String {
+		return "s:" + x.String()
+	}
+
+	if i := coerceToInt(x); i != nil {
+		return "n:" + strconv.FormatInt(*i, 10)
+	}
+
+	if f := coerceToFloat(x); f != nil {
+		if *f == float64(int64(*f)) {
+			return "n:" + strconv.FormatInt(int64(*f), 10)
+		}
+		return "n:" + strconv.FormatFloat(*f, 'g', -1, 64)
+	}
+
+	return fmt.Sprintf("%T:%v", x.Interface(), x.Interface())
+}
+
+// identIndex returns the index of the column referred to by an unqualified
+// identifier, or -1 if there is no such column
+func (i *IntermediateTable) identIndex(name string) int {
+	for idx, column := range i.Columns {
+		if name == column || (i.Source != nil && i.Source.Name+"."+column == name) || (i.Source == nil && strings.HasSuffix(column, "."+name)) {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+// refIndex returns the index of the column referred to by a qualified
+// reference, or -1 if there is no such column
+func (i *IntermediateTable) refIndex(t *sql.QualifiedRef) int {
+	lh := t.Table.Name
+	rh := "*"
+	if t.Column != nil {
+		rh = t.Column.Name
+	}
+	ref := lh + "." + rh
+
+	// Columns of a single source table are not prefixed with the table name
+	if i.Source != nil && (lh == i.Source.Name || i.Aliases[lh] == i.Source.Name) {
+		ref = rh
+	}
+
+	aliased := i.Aliases[lh] + "." + rh
+	for idx, column := range i.Columns {
+		if ref == column || aliased == column {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+// operatorString returns the text of the operator op, which the parser does
+// not have for the JSON operators
+func operatorString(op sql.Token) string {
+	switch op {
+	case sql.JSON_EXTRACT_JSON:
+		return "->"
+	case sql.JSON_EXTRACT_SQL:
+		return "->>"
+	}
+
+	return op.String()
+}
+
 func (i *IntermediateTable) evaluate(n sql.Node, row ResultRow) reflect.Value {
 	switch t := n.(type) {
 	case *sql.BinaryExpr:
+		switch t.Op {
+		case sql.LIKE, sql.NOTLIKE, sql.GLOB, sql.NOTGLOB, sql.REGEXP, sql.NOTREGEXP:
+			return i.evaluateMatch(t, row)
+		case sql.IN, sql.NOTIN:
+			return i.evaluateIn(t, row)
+		case sql.BETWEEN, sql.NOTBETWEEN:
+			return i.evaluateBetween(t, row)
+		case sql.ESCAPE:
+			raise("ESCAPE is only valid as part of a LIKE expression")
+		case sql.MATCH, sql.JSON_EXTRACT_JSON, sql.JSON_EXTRACT_SQL:
+			raise("unsupported operator: %s", operatorString(t.Op))
+		}
+
 		x := i.evaluate(t.X, row)
 		y := i.evaluate(t.Y, row)
 
-		xI, yI := coerceToInt(x), coerceToInt(y)
+		switch t.Op {
+		case sql.EQ, sql.NE, sql.GT, sql.GE, sql.LT, sql.LE, sql.IS, sql.ISNOT:
+			x, y = comparisonOperands(t.X, t.Y, x, y)
+		}
 
 		switch t.Op {
 		case sql.AND:
-			return reflect.ValueOf(x.Bool() && y.Bool())
+			return logicalAnd(x, y)
 		case sql.OR:
-			return reflect.ValueOf(x.Bool() || y.Bool())
+			return logicalOr(x, y)
+		case sql.IS:
+			return reflect.ValueOf(!isDistinct(x, y))
+		case sql.ISNOT:
+			return reflect.ValueOf(isDistinct(x, y))
+		}
+
+		// Any other operator yields NULL when either operand is NULL
+		if !x.IsValid() || !y.IsValid() {
+			return null
+		}
+
+		switch t.Op {
+		case sql.PLUS, sql.MINUS, sql.STAR, sql.SLASH, sql.REM, sql.CONCAT,
+			sql.BITAND, sql.BITOR, sql.LSHIFT, sql.RSHIFT:
+			return evaluateArithmetic(t.Op, x, y)
 		case sql.EQ:
-			return reflect.ValueOf(reflect.DeepEqual(x.Interface(), y.Interface()))
+			return reflect.ValueOf(valuesEqual(x, y))
 		case sql.NE:
-			return reflect.ValueOf(!reflect.DeepEqual(x.Interface(), y.Interface()))
-		case sql.GT:
-			// FIXME: This should be an error
-			if xI == nil || yI == nil {
-				return reflect.ValueOf(false)
-			}
-			return reflect.ValueOf(*xI > *yI)
-		case sql.GE:
-			// FIXME: This should be an error
-			if xI == nil || yI == nil {
-				return reflect.ValueOf(false)
-			}
-			return reflect.ValueOf(*xI >= *yI)
-		case sql.LT:
-			// FIXME: This should be an error
-			if xI == nil || yI == nil {
-				return reflect.ValueOf(false)
-			}
-			return reflect.ValueOf(*xI < *yI)
-		case sql.LE:
-			// FIXME: This should be an error
-			if xI == nil || yI == nil {
-				return reflect.ValueOf(false)
-			}
-			return reflect.ValueOf(*xI <= *yI)
-		case sql.LIKE:
-			match := strings.ReplaceAll(y.String(), "%", ".*")
-			matched, err := regexp.MatchString(match, x.String())
-			// FIXME: This should be an error
-			if err != nil {
-				return reflect.ValueOf(false)
-			}
-			return reflect.ValueOf(matched)
-		case sql.NOTLIKE:
-			match := strings.ReplaceAll(y.String(), "%", ".*")
-			matched, err := regexp.MatchString(match, x.String())
-			// FIXME: This should be an error
-			if err != nil {
-				return reflect.ValueOf(false)
-			}
-			return reflect.ValueOf(!matched)
+			return reflect.ValueOf(!valuesEqual(x, y))
+		case sql.GT, sql.GE, sql.LT, sql.LE:
+			return evaluateComparison(t.Op, x, y)
 		}
+
+		raise("unsupported operator: %s", operatorString(t.Op))
+	case *sql.UnaryExpr:
+		return evaluateUnary(t.Op, i.evaluate(t.X, row))
+	case *sql.CaseExpr:
+		return i.evaluateCase(t, row)
+	case *sql.CastExpr:
+		return evaluateCast(i.evaluate(t.X, row), t.Type.Name.Name)
+	case *sql.Null:
+		isNull := !i.evaluate(t.X, row).IsValid()
+		return reflect.ValueOf(isNull == (t.Op == sql.ISNULL))
+	case *sql.NullLit:
+		return null
+	case *sql.ParenExpr:
+		return i.evaluate(t.X, row)
 	case *sql.NumberLit:
-		i, err := strconv.Atoi(t.Value)
-		if err != nil {
-			panic(err)
-		}
-		return reflect.ValueOf(int64(i))
+		return parseNumberLit(t.Value)
 	case *sql.BoolLit:
 		return reflect.ValueOf(t.Value)
 	case *sql.StringLit:
 		return reflect.ValueOf(t.Value)
 	case *sql.QualifiedRef:
-		lh := t.Table.Name
-		rh := "*"
-		if t.Column != nil {
-			rh = t.Column.Name
+		if idx := i.refIndex(t); idx > -1 {
+			if row[idx].Value.Kind() == reflect.Bool {
+				if i := coerceToInt(row[idx].Value); i != nil {
+					return reflect.ValueOf(*i)
+				}
+			}
+
+			return row[idx].Value
 		}
-		ref := lh + "." + rh
 
-		for idx, column := range i.Columns {
-			if ref == column || i.Aliases[lh]+"."+rh == column {
-				if row[idx].Value.Kind() == reflect.Bool {
-					if i := coerceToInt(row[idx].Value); i != nil {
-						return reflect.ValueOf(*i)
-					}
+		return i.outerValue(t)
+
+	case *sql.Ident:
+		if idx := i.identIndex(t.Name); idx > -1 {
+			if row[idx].Value.Kind() == reflect.Bool {
+				if i := coerceToInt(row[idx].Value); i != nil {
+					return reflect.ValueOf(*i)
 				}
+			}
+
+			return row[idx].Value
+		}
 
-				return row[idx].Value
+		return i.outerValue(t)
+	case *sql.BindExpr:
+		return i.execution().parameter(t)
+	case sql.SelectExpr:
+		return i.evaluateScalarSubquery(t.SelectStatement, row)
+	case *sql.Exists:
+		exists := len(i.subquery(t.Select, row)) > 0
+		return reflect.ValueOf(exists != t.Not.IsValid())
+	case *sql.Call:
+		if t.Over != nil {
+			idx, ok := i.windows[t]
+			if !ok {
+				raise("misuse of window function %s()", t.Name.Name)
 			}
+			return row[idx].Value
 		}
 
-		return reflect.ValueOf(nil)
+		name := strings.ToLower(t.Name.Name)
 
-	case *sql.Ident:
-		for idx, column := range i.Columns {
-			if t.Name == column || (i.Source != nil && i.Source.Name+"."+column == t.Name) {
-				if row[idx].Value.Kind() == reflect.Bool {
-					if i := coerceToInt(row[idx].Value); i != nil {
-						return reflect.ValueOf(*i)
-					}
-				}
+		if f, ok := i.sqlizer.registeredFunction(name); ok {
+			if f.aggregate != nil {
+				checkArity(t, f.minArgs(), f.maxArgs())
+				return i.aggregate(t, f.aggregate(t), false)
+			}
+
+			return f.scalar(i.evaluateArguments(t, f.minArgs(), f.maxArgs(), row))
+		}
 
-				return row[idx].Value
+		if i.sqlizer.isAggregateCall(t) {
+			f := functionMap[name]
+			if t.Star.Line == 0 || name != "count" {
+				checkArity(t, f.minArgs, f.maxArgs)
 			}
+
+			return i.aggregate(t, f.init(), true)
+		}
+
+		if f, ok := scalarFunctionMap[name]; ok {
+			return f.function(i.evaluateArguments(t, f.minArgs, f.maxArgs, row))
+		}
+
+		if f, ok := dateTimeFunctionMap[name]; ok {
+			return f.function(i.now, i.evaluateArguments(t, f.minArgs, f.maxArgs, row))
 		}
 
-		return reflect.ValueOf(nil)
+		raise("no such function: %s", t.Name.Name)
 	default:
-		panic("unhandled type: " + reflect.TypeOf(n).String())
+		raise("unsupported expression: %s", reflect.TypeOf(n).String())
 	}
 	return reflect.ValueOf(false)
 }
 
+// project produces the values of a single result column for row. Plain
+// column references are copied as-is, '*' expands to every column, and any
+// other expression is evaluated.
+func (i *IntermediateTable) project(column *sql.ResultColumn, row ResultRow) []ResultValue {
+	if column.Star.Line > 0 {
+		return i.expandStar("", row)
+	}
+
+	switch t := column.Expr.(type) {
+	case *sql.Ident:
+		if idx := i.identIndex(t.Name); idx > -1 {
+			return []ResultValue{{Name: columnName(column), Value: row[idx].Value}}
+		}
+	case *sql.QualifiedRef:
+		if t.Star.Line != 0 {
+			return i.expandStar(t.Table.Name, row)
+		}
+
+		if idx := i.refIndex(t); idx > -1 {
+			return []ResultValue{{Name: columnName(column), Value: row[idx].Value}}
+		}
+	}
+
+	return []ResultValue{{
+		Name:  columnName(column),
+		Value: i.evaluate(column.Expr, row),
+	}}
+}
+
+// expandStar returns the values in row of every column belonging to the
+// table (or alias) named table, or of every column if table is empty
+func (i *IntermediateTable) expandStar(table string, row ResultRow) []ResultValue {
+	var values []ResultValue
+
+	for idx, column := range i.Columns {
+		name := column
+
+		if i.Source != nil {
+			if table != "" && table != i.Source.Name && i.Aliases[table] != i.Source.Name {
+				continue
+			}
+		} else if prefix, c, ok := strings.Cut(column, "."); ok {
+			if table != "" && prefix != table && prefix != i.Aliases[table] {
+				continue
+			}
+			if table == "" && i.usingColumns[idx] {
+				continue
+			}
+			name = c
+		}
+
+		values = append(values, ResultValue{Name: name, Value: row[idx].Value})
+	}
+
+	return values
+}
+
+// tryEvaluate evaluates n against row, returning any error raised by the
+// evaluator rather than panicking
+func (i *IntermediateTable) tryEvaluate(n sql.Node, row ResultRow) (v reflect.Value, err error) {
+	defer recoverEvaluation(&err)
+	return i.evaluate(n, row), nil
+}
+
+// evaluateMatch evaluates the pattern matching operators LIKE, GLOB and
+// REGEXP, along with their negations
+func (i *IntermediateTable) evaluateMatch(t *sql.BinaryExpr, row ResultRow) reflect.Value {
+	subject := i.evaluate(t.X, row)
+
+	patternExpr := t.Y
+	escape := utf8.RuneError
+	if e, ok := t.Y.(*sql.BinaryExpr); ok && e.Op == sql.ESCAPE {
+		if t.Op != sql.LIKE && t.Op != sql.NOTLIKE {
+			raise("ESCAPE is only valid as part of a LIKE expression")
+		}
+
+		patternExpr = e.X
+
+		escapeValue := i.evaluate(e.Y, row)
+		if !escapeValue.IsValid() {
+			return null
+		}
+
+		s := coerceToString(escapeValue)
+		if utf8.RuneCountInString(s) != 1 {
+			raise("ESCAPE expression must be a single character")
+		}
+		escape, _ = utf8.DecodeRuneInString(s)
+	}
+
+	patternValue := i.evaluate(patternExpr, row)
+	if !subject.IsValid() || !patternValue.IsValid() {
+		return null
+	}
+
+	x, pattern := coerceToString(subject), coerceToString(patternValue)
+
+	var matched bool
+	switch t.Op {
+	case sql.LIKE, sql.NOTLIKE:
+		matched = matchLike(pattern, x, escape)
+	case sql.GLOB, sql.NOTGLOB:
+		matched = matchGlob(pattern, x)
+	case sql.REGEXP, sql.NOTREGEXP:
+		var err error
+		matched, err = matchRegexp(pattern, x)
+		if err != nil {
+			raise("invalid REGEXP pattern: %v", err)
+		}
+	}
+
+	switch t.Op {
+	case sql.NOTLIKE, sql.NOTGLOB, sql.NOTREGEXP:
+		return reflect.ValueOf(!matched)
+	}
+
+	return reflect.ValueOf(matched)
+}
+
+// evaluateIn evaluates IN and NOT IN against a list of values. As in SQLite,
+// the result is NULL rather than false when no value matches but either the
+// left operand or a value in the list is NULL.
+func (i *IntermediateTable) evaluateIn(t *sql.BinaryExpr, row ResultRow) reflect.Value {
+	list, ok := t.Y.(*sql.ExprList)
+	if !ok {
+		raise("unsupported right-hand side of IN: %s", reflect.TypeOf(t.Y).String())
+	}
+
+	// The values are either those of the list, or those of the single
+	// column of a subquery. Those of a list have no affinity, whereas
+	// those of a subquery have the affinity of its column.
+	var values []func() reflect.Value
+	var valueExpr sql.Expr
+	if s, ok := subqueryOf(list); ok {
+		if len(s.Columns) > 0 {
+			valueExpr = s.Columns[0].Expr
+		}
+
+		for _, r := range i.subquery(s, row) {
+			if len(r) != 1 {
+				raise("sub-select returns %d columns - expected 1", len(r))
+			}
+
+			value := r[0].Value
+			values = append(values, func() reflect.Value { return value })
+		}
+	} else {
+		for _, expr := range list.Exprs {
+			values = append(values, func() reflect.Value { return i.evaluate(expr, row) })
+		}
+	}
+
+	found := reflect.ValueOf(false)
+	if len(values) > 0 {
+		x := i.evaluate(t.X, row)
+
+		for _, value := range values {
+			y := value()
+
+			if !x.IsValid() || !y.IsValid() {
+				found = null
+				continue
+			}
+
+			if valuesEqual(comparisonOperands(t.X, valueExpr, x, y)) {
+				found = reflect.ValueOf(true)
+				break
+			}
+		}
+	}
+
+	if t.Op == sql.NOTIN {
+		return evaluateUnary(sql.NOT, found)
+	}
+
+	return found
+}
+
+// subqueryOf returns the subquery of "x IN (SELECT ...)", which the parser
+// reads as a list holding a single SELECT
+func subqueryOf(list *sql.ExprList) (*sql.SelectStatement, bool) {
+	if len(list.Exprs) != 1 {
+		return nil, false
+	}
+
+	s, ok := list.Exprs[0].(sql.SelectExpr)
+	return s.SelectStatement, ok
+}
+
+// subquery executes a subquery of an expression evaluated against row,
+// which the subquery may refer to
+func (i *IntermediateTable) subquery(s *sql.SelectStatement, row ResultRow) ResultRows {
+	if i.exec == nil {
+		raise("subqueries are not supported here")
+	}
+
+	return i.exec.subquery(s, &outerRow{table: i, row: row})
+}
+
+// evaluateScalarSubquery evaluates a subquery used as a value, which is the
+// value of the first column of its first row, or NULL if there are no rows
+func (i *IntermediateTable) evaluateScalarSubquery(s *sql.SelectStatement, row ResultRow) reflect.Value {
+	if len(s.Columns) != 1 || s.Columns[0].Star.IsValid() {
+		raise("sub-select returns %d columns - expected 1", len(s.Columns))
+	}
+
+	r := i.subquery(s, row)
+	if len(r) == 0 || len(r[0]) == 0 {
+		return null
+	}
+
+	return r[0][0].Value
+}
+
+// outerValue evaluates a reference to a column which the table does not
+// have. In a subquery this refers to a row of an enclosing statement, and
+// otherwise there is no such column.
+func (i *IntermediateTable) outerValue(n sql.Expr) reflect.Value {
+	if i.exec != nil {
+		if v, ok := i.exec.resolveOuter(n); ok {
+			return v
+		}
+	}
+
+	switch t := n.(type) {
+	case *sql.Ident:
+		raise("no such column: %s", t.Name)
+	case *sql.QualifiedRef:
+		if t.Column != nil {
+			raise("no such column: %s.%s", t.Table.Name, t.Column.Name)
+		}
+	}
+
+	return null
+}
+
+// evaluateBetween evaluates BETWEEN and NOT BETWEEN, where "x BETWEEN y AND
+// z" is equivalent to "x >= y AND x <= z"
+func (i *IntermediateTable) evaluateBetween(t *sql.BinaryExpr, row ResultRow) reflect.Value {
+	rng, ok := t.Y.(*sql.Range)
+	if !ok {
+		raise("expected range expression after BETWEEN")
+	}
+
+	x := i.evaluate(t.X, row)
+	lx, low := comparisonOperands(t.X, rng.X, x, i.evaluate(rng.X, row))
+	hx, high := comparisonOperands(t.X, rng.Y, x, i.evaluate(rng.Y, row))
+	between := logicalAnd(
+		evaluateComparison(sql.GE, lx, low),
+		evaluateComparison(sql.LE, hx, high),
+	)
+
+	if t.Op == sql.NOTBETWEEN {
+		return evaluateUnary(sql.NOT, between)
+	}
+
+	return between
+}
+
+// evaluateCase evaluates both forms of CASE. With an operand, the result of
+// the first WHEN whose value equals the operand is chosen; without one, the
+// result of the first WHEN whose condition is true. If no WHEN matches, the
+// result is the ELSE expression, or NULL if there is none.
+func (i *IntermediateTable) evaluateCase(t *sql.CaseExpr, row ResultRow) reflect.Value {
+	var operand reflect.Value
+	if t.Operand != nil {
+		operand = i.evaluate(t.Operand, row)
+	}
+
+	for _, block := range t.Blocks {
+		condition := i.evaluate(block.Condition, row)
+
+		var matched bool
+		if t.Operand != nil {
+			matched = operand.IsValid() && condition.IsValid() && valuesEqual(comparisonOperands(t.Operand, block.Condition, operand, condition))
+		} else {
+			matched = isTrue(condition)
+		}
+
+		if matched {
+			return i.evaluate(block.Body, row)
+		}
+	}
+
+	if t.ElseExpr != nil {
+		return i.evaluate(t.ElseExpr, row)
+	}
+
+	return null
+}
+
+// aggregate runs an aggregate function across every row of the table,
+// stepping acc with the values of the call's arguments for each row. The
+// built-in aggregates skip rows for which the first argument is NULL, as
+// SQLite's do, whereas registered aggregates are given every row. Rows for
+// which the call's FILTER clause is not true are skipped by both. With
+// DISTINCT, each value of the argument is given to acc only once.
+func (i *IntermediateTable) aggregate(call *sql.Call, acc Accumulator, skipNull bool) reflect.Value {
+	var seen map[string]bool
+	if call.Distinct.IsValid() {
+		if len(call.Args) != 1 {
+			raise("DISTINCT aggregates must have exactly one argument")
+		}
+		seen = make(map[string]bool)
+	}
+
+	for _, row := range i.Rows {
+		if call.Filter != nil && !isTrue(i.evaluate(call.Filter.X, row)) {
+			continue
+		}
+
+		args := make([]reflect.Value, len(call.Args))
+		for idx, arg := range call.Args {
+			args[idx] = i.evaluate(arg, row)
+		}
+
+		if len(args) > 0 {
+			if skipNull && !args[0].IsValid() {
+				continue
+			}
+
+			if seen != nil {
+				key := valueKey(args[0])
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+			}
+		}
+
+		if extreme, ok := acc.(*extremeAccumulator); ok {
+			extreme.stepRow(args, row)
+			continue
+		}
+		acc.Step(args)
+	}
+
+	return acc.Final()
+}
+
 func (i *IntermediateTable) Filter(n sql.Node) *IntermediateTable {
 	var result IntermediateTable
 
@@ -172,11 +887,15 @@ func (i *IntermediateTable) Filter(n sql.Node) *IntermediateTable {
 	result.Source = i.Source
 	result.Aliases = i.Aliases
 	result.Columns = i.Columns
+	result.sqlizer = i.sqlizer
+	result.now = i.now
+	result.usingColumns = i.usingColumns
+	result.exec = i.exec
 
 	for _, row := range i.Rows {
-		v := i.evaluate(n, row)
+		i.execution().checkContext()
 
-		if v.Kind() == reflect.Bool && v.Bool() {
+		if isTrue(i.evaluate(n, row)) {
 			result.Rows = append(result.Rows, row)
 		}
 	}
@@ -184,82 +903,58 @@ func (i *IntermediateTable) Filter(n sql.Node) *IntermediateTable {
 	return &result
 }
 
-func NewIntermediateTable() *IntermediateTable {
-	return &IntermediateTable{
-		Aliases: make(map[string]string),
-	}
-}
+// Group partitions the rows of the table by the values of the given
+// expressions, returning one table per distinct combination in the order
+// each was first seen. With no expressions, every row is placed in a single
+// group.
+func (i *IntermediateTable) Group(exprs []sql.Expr) []*IntermediateTable {
+	var groups []*IntermediateTable
+	lookup := make(map[string]*IntermediateTable)
 
-func (s *SQLizer) valueOf(n sql.Node, v reflect.Value, mappings map[string]ColumnMapping) reflect.Value {
-	switch t := n.(type) {
-	case *sql.BinaryExpr:
-		x := s.valueOf(t.X, v, mappings)
-		y := s.valueOf(t.Y, v, mappings)
+	for _, row := range i.Rows {
+		i.execution().checkContext()
 
-		xI, yI := coerceToInt(x), coerceToInt(y)
+		var key strings.Builder
+		for _, expr := range exprs {
+			key.WriteString(valueKey(i.evaluate(expr, row)))
+			key.WriteByte(0)
+		}
 
-		switch t.Op {
-		case sql.AND:
-			return reflect.ValueOf(x.Bool() && y.Bool())
-		case sql.OR:
-			return reflect.ValueOf(x.Bool() || y.Bool())
-		case sql.EQ:
-			return reflect.ValueOf(reflect.DeepEqual(x.Interface(), y.Interface()))
-		case sql.NE:
-			return reflect.ValueOf(!reflect.DeepEqual(x.Interface(), y.Interface()))
-		case sql.GT:
-			// FIXME: This should be an error
-			if xI == nil || yI == nil {
-				return reflect.ValueOf(false)
-			}
-			return reflect.ValueOf(*xI > *yI)
-		case sql.GE:
-			// FIXME: This should be an error
-			if xI == nil || yI == nil {
-				return reflect.ValueOf(false)
-			}
-			return reflect.ValueOf(*xI >= *yI)
-		case sql.LT:
-			// FIXME: This should be an error
-			if xI == nil || yI == nil {
-				return reflect.ValueOf(false)
-			}
-			return reflect.ValueOf(*xI < *yI)
-		case sql.LE:
-			// FIXME: This should be an error
-			if xI == nil || yI == nil {
-				return reflect.ValueOf(false)
+		group, ok := lookup[key.String()]
+		if !ok {
+			group = &IntermediateTable{
+				Source:       i.Source,
+				Aliases:      i.Aliases,
+				Columns:      i.Columns,
+				sqlizer:      i.sqlizer,
+				now:          i.now,
+				usingColumns: i.usingColumns,
+				exec:         i.exec,
 			}
-			return reflect.ValueOf(*xI <= *yI)
-		case sql.LIKE:
-			match := strings.ReplaceAll(y.String(), "%", ".*")
-			matched, err := regexp.MatchString(match, x.String())
-			if err != nil {
-				return reflect.ValueOf(false)
-			}
-			return reflect.ValueOf(matched)
-		case sql.NOTLIKE:
-			match := strings.ReplaceAll(y.String(), "%", ".*")
-			matched, err := regexp.MatchString(match, x.String())
-			if err != nil {
-				return reflect.ValueOf(false)
-			}
-			return reflect.ValueOf(!matched)
-		}
-	case *sql.NumberLit:
-		i, err := strconv.Atoi(t.Value)
-		if err != nil {
-			panic(err)
+			lookup[key.String()] = group
+			groups = append(groups, group)
 		}
-		return reflect.ValueOf(i)
-	case *sql.StringLit:
-		return reflect.ValueOf(t.Value)
-	case *sql.Ident:
-		return v.Elem().FieldByName(mappings[t.Name].GoField)
-	default:
-		panic("unhandled type: " + reflect.TypeOf(n).String())
+
+		group.Rows = append(group.Rows, row)
+	}
+
+	return groups
+}
+
+// execution returns the execution of the statement the table belongs to,
+// or nil if it does not belong to one
+func (i *IntermediateTable) execution() *execution {
+	if i.exec == nil {
+		return nil
+	}
+
+	return i.exec.e
+}
+
+func NewIntermediateTable() *IntermediateTable {
+	return &IntermediateTable{
+		Aliases: make(map[string]string),
 	}
-	return reflect.ValueOf(false)
 }
 
 func (s *SQLizer) Matches(filter sql.Node, data any) bool {
@@ -272,10 +967,16 @@ func (s *SQLizer) Matches(filter sql.Node, data any) bool {
 		return true
 	}
 
-	value := s.valueOf(filter, reflect.ValueOf(data), table.ColumnMappings)
-	if value.Kind() == reflect.Bool {
-		return value.Bool()
+	intermediate := NewIntermediateTable()
+	intermediate.Source = table
+	intermediate.Columns = table.Columns
+	intermediate.sqlizer = s
+	intermediate.now = s.Now()
+
+	value, err := intermediate.tryEvaluate(filter, table.rowFor(reflect.ValueOf(data)))
+	if err != nil {
+		return false
 	}
 
-	return false
+	return isTrue(value)
 }
@@ -54,14 +54,20 @@ func TestE2E(t *testing.T) {
 			testName := info.Name()
 			expectation := filepath.Join(expectationsPath, testName)
 			t.Run(testName, func(t *testing.T) {
-				sql, query, err := SQLizerForInputFile(path)
+				sql, query, args, err := SQLizerForInputFile(path)
 				if err != nil {
 					t.Fatal(err)
 				}
 
+				ctx, cancel, err := ContextForInputFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer cancel()
+
 				var output string
 
-				r, err := sql.Execute(query)
+				r, err := sql.ExecuteContext(ctx, query, args...)
 				if err != nil {
 					output = "Fail: " + err.Error() + "\n"
 				} else {
@@ -0,0 +1,39 @@
+package test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dburkart/duckql"
+	"github.com/dburkart/duckql/test/types"
+	"github.com/rqlite/sql"
+)
+
+// rowsBacking is a backing which implements only BackingStore, returning
+// the same rows for every statement
+type rowsBacking struct {
+	rows duckql.ResultRows
+}
+
+func (b *rowsBacking) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
+	return b, n, nil
+}
+
+func (b *rowsBacking) VisitEnd(n sql.Node) (sql.Node, error) {
+	return n, nil
+}
+
+func (b *rowsBacking) Rows() duckql.ResultRows {
+	return b.rows
+}
+
+func TestBackingWithoutRowsWithError(t *testing.T) {
+	s := duckql.Initialize(&types.Account{})
+	s.SetPermissions(duckql.AllowSelectStatements)
+	s.SetBacking(&rowsBacking{rows: duckql.ResultRows{
+		duckql.ResultRow{duckql.ResultValue{Name: "username", Value: reflect.ValueOf("alice")}},
+	}})
+
+	rows, err := s.Execute("SELECT username FROM accounts")
+	expectRows(t, rows, err, "alice")
+}
@@ -0,0 +1,72 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dburkart/duckql"
+	"github.com/dburkart/duckql/test/types"
+)
+
+// joinData returns the given number of accounts, spread evenly across the
+// given number of organizations
+func joinData(accounts, organizations int) []any {
+	a := make([]*types.Account, accounts)
+	for i := range a {
+		a[i] = &types.Account{
+			ID:             i,
+			Username:       fmt.Sprintf("user%d", i),
+			Email:          fmt.Sprintf("user%d@example.com", i),
+			OrganizationID: i % organizations,
+		}
+	}
+
+	o := make([]*types.Organization, organizations)
+	for i := range o {
+		o[i] = &types.Organization{
+			ID:   i,
+			Name: fmt.Sprintf("Organization %d", i),
+		}
+	}
+
+	return []any{a, o}
+}
+
+func benchmarkJoin(b *testing.B, accounts, organizations int, query string) {
+	data := joinData(accounts, organizations)
+
+	for i := 0; i < b.N; i++ {
+		s := duckql.Initialize(&types.Account{}, &types.Organization{})
+		s.SetPermissions(duckql.AllowSelectStatements)
+		s.SetBacking(duckql.NewSliceFilter(s, data))
+
+		rows, err := s.Execute(query)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if len(rows) != accounts {
+			b.Fatalf("expected %d rows, got %d", accounts, len(rows))
+		}
+	}
+}
+
+// BenchmarkJoin measures an equality join, which is performed as a hash
+// join
+func BenchmarkJoin(b *testing.B) {
+	for _, size := range [][2]int{{1000, 100}, {10000, 1000}, {50000, 5000}} {
+		b.Run(fmt.Sprintf("%dx%d", size[0], size[1]), func(b *testing.B) {
+			benchmarkJoin(b, size[0], size[1], "SELECT accounts.username, org.name FROM accounts JOIN organizations AS org ON accounts.organization_id = org.id;")
+		})
+	}
+}
+
+// BenchmarkJoinNestedLoop measures the same join with a constraint that
+// cannot be hashed, which tests every pair of rows
+func BenchmarkJoinNestedLoop(b *testing.B) {
+	for _, size := range [][2]int{{1000, 100}, {3000, 300}} {
+		b.Run(fmt.Sprintf("%dx%d", size[0], size[1]), func(b *testing.B) {
+			benchmarkJoin(b, size[0], size[1], "SELECT accounts.username, org.name FROM accounts JOIN organizations AS org ON accounts.organization_id = org.id OR org.id < 0;")
+		})
+	}
+}
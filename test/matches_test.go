@@ -0,0 +1,55 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/dburkart/duckql"
+	"github.com/dburkart/duckql/test/types"
+	"github.com/rqlite/sql"
+)
+
+// TestMatchesAgreesWithWhere checks that Matches treats the value of a
+// filter as true exactly when a WHERE clause does
+func TestMatchesAgreesWithWhere(t *testing.T) {
+	account := &types.Account{ID: 1, Username: "user1", Email: "user1@gmail.com", OrganizationID: 23}
+
+	tests := []struct {
+		filter   string
+		expected bool
+	}{
+		{"id = 1", true},
+		{"id = 2", false},
+		{"id", true},
+		{"id - 1", false},
+		{"organization_id + 0", true},
+		{"'1st'", true},
+		{"'first'", false},
+		{"NULL", false},
+		{"id IS NOT NULL AND organization_id", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.filter, func(t *testing.T) {
+			s := duckql.Initialize(account)
+			s.SetPermissions(duckql.AllowSelectStatements)
+			s.SetBacking(duckql.NewSliceFilter(s, []any{account}))
+
+			filter, err := sql.ParseExprString(test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := s.Matches(filter, account); got != test.expected {
+				t.Fatalf("expected Matches to return %v, got %v", test.expected, got)
+			}
+
+			rows, err := s.Execute("SELECT username FROM accounts WHERE " + test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(rows) > 0; got != test.expected {
+				t.Fatalf("expected WHERE to match %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
@@ -1,12 +1,16 @@
 package test
 
 import (
+	"context"
+	gosql "database/sql"
+	"encoding/json"
 	"fmt"
 	"github.com/dburkart/duckql"
 	"github.com/dburkart/duckql/test/types"
 	"os"
 	"reflect"
 	"strings"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
@@ -281,33 +285,56 @@ type StructDescription struct {
 	Fields []StructDescriptionField
 }
 
-func SQLizerForInputFile(path string) (*duckql.SQLizer, string, error) {
+func SQLizerForInputFile(path string) (*duckql.SQLizer, string, []any, error) {
 	sections, err := ParseFile(path)
 	if err != nil {
-		return nil, "", err
+		return nil, "", nil, err
 	}
 
 	// First, we turn all definitions into structs
 	var typeList []any
 	var fullData []any
 	var query string
+	var now *time.Time
+	var functions []string
+	var args []any
 	for _, section := range sections {
 		if section.Type == "data" {
 			t := types.TypeByName(section.Of)
 			if t == nil {
-				return nil, "", fmt.Errorf("no such data type %q", section.Of)
+				return nil, "", nil, fmt.Errorf("no such data type %q", section.Of)
 			}
 
 			typeList = append(typeList, t)
 
 			i, err := types.UnmarshallData(section.Of, []byte(section.Text))
 			if err != nil {
-				return nil, "", err
+				return nil, "", nil, err
 			}
 
 			fullData = append(fullData, i)
 		}
 
+		if section.Type == "now" {
+			t, err := time.Parse(time.RFC3339, section.Text)
+			if err != nil {
+				return nil, "", nil, err
+			}
+
+			now = &t
+		}
+
+		if section.Type == "functions" {
+			functions = append(functions, strings.Fields(section.Text)...)
+		}
+
+		if section.Type == "args" {
+			args, err = parseArgs(section.Text)
+			if err != nil {
+				return nil, "", nil, err
+			}
+		}
+
 		if section.Type == "query" {
 			query = section.Text
 		}
@@ -318,5 +345,80 @@ func SQLizerForInputFile(path string) (*duckql.SQLizer, string, error) {
 	sql.SetPermissions(duckql.AllowSelectStatements)
 	sql.SetBacking(duckql.NewSliceFilter(sql, fullData))
 
-	return sql, query, nil
+	for _, name := range functions {
+		if err := types.RegisterFunction(sql, name); err != nil {
+			return nil, "", nil, err
+		}
+	}
+
+	if now != nil {
+		sql.SetClock(func() time.Time {
+			return *now
+		})
+	}
+
+	return sql, query, args, nil
+}
+
+// ContextForInputFile returns the context in which the query of an input
+// file is executed, which has the deadline given by any timeout section
+func ContextForInputFile(path string) (context.Context, context.CancelFunc, error) {
+	sections, err := ParseFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, section := range sections {
+		if section.Type == "timeout" {
+			timeout, err := time.ParseDuration(section.Text)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			return ctx, cancel, nil
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return ctx, cancel, nil
+}
+
+// parseArgs parses the arguments of a query, given as a JSON array. Each
+// object in the array gives named arguments, and anything else is a
+// positional argument. Whole numbers are given as integers.
+func parseArgs(text string) ([]any, error) {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+
+	var values []any
+	if err := decoder.Decode(&values); err != nil {
+		return nil, err
+	}
+
+	var args []any
+	for _, value := range values {
+		if named, ok := value.(map[string]any); ok {
+			for name, v := range named {
+				args = append(args, gosql.Named(name, argValue(v)))
+			}
+			continue
+		}
+
+		args = append(args, argValue(value))
+	}
+
+	return args, nil
+}
+
+func argValue(value any) any {
+	if n, ok := value.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return i
+		}
+		f, _ := n.Float64()
+		return f
+	}
+
+	return value
 }
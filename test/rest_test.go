@@ -0,0 +1,103 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dburkart/duckql"
+	"github.com/dburkart/duckql/test/types"
+)
+
+// restSQLizer returns a SQLizer whose accounts are read from url
+func restSQLizer(t *testing.T, url string, handler func(*http.Response) (any, error)) *duckql.SQLizer {
+	t.Helper()
+
+	s := duckql.Initialize(&types.Account{})
+	s.SetPermissions(duckql.AllowSelectStatements)
+
+	backing := duckql.NewRESTBacking(s)
+	if err := backing.Get(&types.Account{}, duckql.RESTOptions{Url: url}, handler); err != nil {
+		t.Fatal(err)
+	}
+	s.SetBacking(backing)
+
+	return s
+}
+
+func decodeAccounts(resp *http.Response) (any, error) {
+	defer resp.Body.Close()
+
+	var accounts []types.Account
+	err := json.NewDecoder(resp.Body).Decode(&accounts)
+	return accounts, err
+}
+
+func TestRESTCancelledWhileFilling(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The statement is cancelled while the table is being filled, after
+	// the request has been made
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	s := restSQLizer(t, server.URL, decodeAccounts)
+
+	_, err := s.ExecuteContext(ctx, "SELECT username FROM accounts")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestRESTRequestFailure(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	s := restSQLizer(t, url, decodeAccounts)
+
+	if _, err := s.Execute("SELECT username FROM accounts"); err == nil {
+		t.Fatal("expected an error for a request which could not be made")
+	}
+}
+
+func TestRESTHandlerFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("not json"))
+	}))
+	defer server.Close()
+
+	s := restSQLizer(t, server.URL, decodeAccounts)
+
+	if _, err := s.Execute("SELECT username FROM accounts"); err == nil {
+		t.Fatal("expected an error for a response which could not be read")
+	}
+}
+
+func TestRESTRows(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode([]types.Account{
+			{ID: 1, Username: "alice"},
+			{ID: 2, Username: "bob"},
+		})
+	}))
+	defer server.Close()
+
+	s := restSQLizer(t, server.URL, decodeAccounts)
+
+	rows, err := s.ExecuteContext(context.Background(), "SELECT username FROM accounts WHERE id = 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := rows.String(); got != "bob" {
+		t.Fatalf("expected bob, got %q", got)
+	}
+}
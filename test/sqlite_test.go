@@ -0,0 +1,118 @@
+package test
+
+import (
+	gosql "database/sql"
+	"testing"
+
+	"github.com/dburkart/duckql"
+	"github.com/dburkart/duckql/test/types"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteSQLizer returns a SQLizer backed by an in-memory database holding
+// the users
+func sqliteSQLizer(t *testing.T, users ...types.User) *duckql.SQLizer {
+	t.Helper()
+
+	db, err := gosql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	// Every connection to ":memory:" has a database of its own
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("CREATE TABLE users (id INTEGER, name TEXT, email TEXT, password_hash TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range users {
+		_, err := db.Exec("INSERT INTO users VALUES (?, ?, ?, ?)", user.ID, user.Name, user.Email, user.PasswordHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := duckql.Initialize(&types.User{})
+	s.SetPermissions(duckql.AllowSelectStatements)
+	s.SetBacking(duckql.NewSQLiteBacking(db, s))
+
+	return s
+}
+
+func TestSQLiteLikeEscape(t *testing.T) {
+	s := sqliteSQLizer(t,
+		types.User{ID: 1, Name: "John Doe"},
+		types.User{ID: 2, Name: "Bob_Jones"},
+	)
+
+	for query, expected := range map[string]string{
+		"SELECT name FROM users WHERE name LIKE '%!_%' ESCAPE '!'":                                    "Bob_Jones",
+		"SELECT name FROM users WHERE id IN (SELECT id FROM users WHERE name LIKE '%!_%' ESCAPE '!')": "Bob_Jones",
+		"SELECT * FROM (SELECT name FROM users WHERE name LIKE '%!_%' ESCAPE '!')":                    "Bob_Jones",
+		"SELECT * FROM users WHERE name LIKE '%!_%' ESCAPE '!'":                                       "2|Bob_Jones|",
+	} {
+		rows, err := s.Execute(query)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+
+		if got := rows.String(); got != expected {
+			t.Fatalf("%s: expected %q, got %q", query, expected, got)
+		}
+	}
+}
+
+func TestSQLiteArgs(t *testing.T) {
+	s := sqliteSQLizer(t,
+		types.User{ID: 1, Name: "John Doe"},
+		types.User{ID: 2, Name: "Bob_Jones"},
+	)
+
+	stmt := prepare(t, s, "SELECT name FROM users WHERE id = ?")
+
+	rows, err := stmt.Query(2)
+	expectRows(t, rows, err, "Bob_Jones")
+
+	rows, err = stmt.Query(1)
+	expectRows(t, rows, err, "John Doe")
+}
+
+func TestSQLiteRightJoin(t *testing.T) {
+	s := sqliteSQLizer(t,
+		types.User{ID: 1, Name: "John Doe"},
+		types.User{ID: 2, Name: "Bob_Jones"},
+	)
+
+	rows, err := s.ExecuteArgs("SELECT a.name, b.name FROM users AS a RIGHT JOIN users AS b ON a.id = b.id + ? ORDER BY b.id", 1)
+	expectRows(t, rows, err, "Bob_Jones|John Doe\n|Bob_Jones")
+}
+
+func TestSQLiteConcurrentQueries(t *testing.T) {
+	s := sqliteSQLizer(t,
+		types.User{ID: 1, Name: "John Doe"},
+		types.User{ID: 2, Name: "Bob_Jones"},
+	)
+
+	queryConcurrently(t, s, "SELECT * FROM users WHERE id IN (SELECT b.id FROM users AS a RIGHT JOIN users AS b ON a.id = b.id + ?)", 0, 1)
+}
+
+func TestSQLiteLimitComma(t *testing.T) {
+	s := sqliteSQLizer(t,
+		types.User{ID: 1, Name: "John Doe"},
+		types.User{ID: 2, Name: "Bob_Jones"},
+		types.User{ID: 3, Name: "Jane Roe"},
+		types.User{ID: 4, Name: "Ann Lee"},
+	)
+
+	for query, expected := range map[string]string{
+		"SELECT name FROM users ORDER BY id LIMIT 1, 2":                                             "Bob_Jones\nJane Roe",
+		"SELECT name FROM users ORDER BY id LIMIT 2 OFFSET 1":                                       "Bob_Jones\nJane Roe",
+		"SELECT name FROM users WHERE id IN (SELECT id FROM users ORDER BY id LIMIT 2, 1)":          "Jane Roe",
+		"SELECT name FROM users WHERE name LIKE '%!_%' ESCAPE '!' OR id > 1 ORDER BY id LIMIT 1, 1": "Jane Roe",
+	} {
+		rows, err := s.Execute(query)
+		expectRows(t, rows, err, expected)
+	}
+}
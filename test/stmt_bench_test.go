@@ -0,0 +1,64 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/dburkart/duckql"
+	"github.com/dburkart/duckql/test/types"
+)
+
+const stmtBenchQuery = "SELECT accounts.username, org.name FROM accounts JOIN organizations AS org ON accounts.organization_id = org.id WHERE accounts.id = ?;"
+
+func stmtBenchSQLizer(cacheSize int) *duckql.SQLizer {
+	s := duckql.Initialize(&types.Account{}, &types.Organization{})
+	s.SetPermissions(duckql.AllowSelectStatements)
+	s.SetBacking(duckql.NewSliceFilter(s, joinData(100, 10)))
+	s.SetStatementCacheSize(cacheSize)
+
+	return s
+}
+
+// BenchmarkExecuteUncached measures a statement which is parsed and
+// validated every time it is executed
+func BenchmarkExecuteUncached(b *testing.B) {
+	s := stmtBenchSQLizer(0)
+
+	for i := 0; i < b.N; i++ {
+		if _, err := s.ExecuteArgs(stmtBenchQuery, i%100); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkExecuteCached measures the same statement, which is found among
+// the statements the SQLizer has prepared
+func BenchmarkExecuteCached(b *testing.B) {
+	s := stmtBenchSQLizer(16)
+
+	for i := 0; i < b.N; i++ {
+		if _, err := s.ExecuteArgs(stmtBenchQuery, i%100); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkStmtQuery measures the same statement, prepared once
+func BenchmarkStmtQuery(b *testing.B) {
+	s := stmtBenchSQLizer(0)
+
+	stmt, err := s.Prepare(stmtBenchQuery)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		rows, err := stmt.Query(i % 100)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if len(rows) != 1 {
+			b.Fatalf("expected 1 row, got %d", len(rows))
+		}
+	}
+}
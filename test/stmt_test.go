@@ -0,0 +1,232 @@
+package test
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dburkart/duckql"
+	"github.com/dburkart/duckql/test/types"
+)
+
+const stmtQuery = "SELECT username FROM accounts WHERE id = ?"
+
+func stmtSQLizer(cacheSize int) *duckql.SQLizer {
+	s := duckql.Initialize(&types.Account{}, &types.Organization{})
+	s.SetPermissions(duckql.AllowSelectStatements)
+	s.SetBacking(duckql.NewSliceFilter(s, joinData(4, 2)))
+	s.SetStatementCacheSize(cacheSize)
+
+	return s
+}
+
+func prepare(t *testing.T, s *duckql.SQLizer, statement string) *duckql.Stmt {
+	t.Helper()
+
+	stmt, err := s.Prepare(statement)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return stmt
+}
+
+func expectRows(t *testing.T, rows duckql.ResultRows, err error, expected string) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := rows.String(); got != expected {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestStmtQueryWithDifferentArgs(t *testing.T) {
+	s := stmtSQLizer(0)
+	stmt := prepare(t, s, stmtQuery)
+
+	rows, err := stmt.Query(1)
+	expectRows(t, rows, err, "user1")
+
+	rows, err = stmt.Query(3)
+	expectRows(t, rows, err, "user3")
+
+	if _, err := stmt.Query(); err == nil {
+		t.Fatal("expected an error for a missing argument")
+	}
+
+	rows, err = stmt.Query(2)
+	expectRows(t, rows, err, "user2")
+}
+
+func TestStatementCacheNormalizes(t *testing.T) {
+	s := stmtSQLizer(8)
+	stmt := prepare(t, s, stmtQuery)
+
+	for _, statement := range []string{
+		"select username from accounts where id = ?;",
+		"SELECT username\n\tFROM accounts\n\tWHERE id = ? -- by id",
+		"SELECT /* the name */ username FROM accounts WHERE id = ?",
+	} {
+		if prepare(t, s, statement) != stmt {
+			t.Fatalf("expected %q to be found among the prepared statements", statement)
+		}
+	}
+
+	for _, statement := range []string{
+		"SELECT username FROM accounts WHERE id = ?1",
+		"SELECT username FROM accounts WHERE id = '?'",
+		"SELECT \"username\" FROM accounts WHERE id = ?",
+	} {
+		if prepare(t, s, statement) == stmt {
+			t.Fatalf("expected %q to be prepared separately", statement)
+		}
+	}
+}
+
+func TestStatementCacheComments(t *testing.T) {
+	s := stmtSQLizer(8)
+
+	// The WHERE clause of the first statement follows the end of the
+	// comment, and that of the second is part of it
+	rows, err := s.Execute("SELECT username FROM accounts -- the second\nWHERE id = 2")
+	expectRows(t, rows, err, "user2")
+
+	rows, err = s.Execute("SELECT username FROM accounts -- the second WHERE id = 2")
+	expectRows(t, rows, err, "user0\nuser1\nuser2\nuser3")
+}
+
+func TestStatementCacheEviction(t *testing.T) {
+	s := stmtSQLizer(2)
+
+	a := prepare(t, s, "SELECT id FROM accounts")
+	b := prepare(t, s, "SELECT username FROM accounts")
+
+	if prepare(t, s, "SELECT id FROM accounts") != a {
+		t.Fatal("expected the first statement to be cached")
+	}
+
+	// The second statement is the one used least recently, and so is
+	// discarded to make room for a third
+	prepare(t, s, "SELECT email FROM accounts")
+
+	if prepare(t, s, "SELECT id FROM accounts") != a {
+		t.Fatal("expected the first statement to still be cached")
+	}
+
+	if prepare(t, s, "SELECT username FROM accounts") == b {
+		t.Fatal("expected the second statement to have been discarded")
+	}
+}
+
+func TestStatementCacheDisabled(t *testing.T) {
+	s := stmtSQLizer(0)
+
+	if prepare(t, s, stmtQuery) == prepare(t, s, stmtQuery) {
+		t.Fatal("expected no statements to be cached")
+	}
+
+	rows, err := s.ExecuteArgs(stmtQuery, 0)
+	expectRows(t, rows, err, "user0")
+}
+
+func TestStmtRevalidatedAfterSetPermissions(t *testing.T) {
+	s := stmtSQLizer(8)
+	stmt := prepare(t, s, stmtQuery)
+
+	s.SetPermissions(duckql.AllowInsertStatements)
+
+	if _, err := stmt.Query(1); err == nil {
+		t.Fatal("expected the statement to be rejected once SELECT is no longer allowed")
+	}
+
+	if _, err := s.ExecuteArgs(stmtQuery, 1); err == nil {
+		t.Fatal("expected the cached statement to be rejected once SELECT is no longer allowed")
+	}
+
+	s.SetPermissions(duckql.AllowSelectStatements)
+
+	rows, err := stmt.Query(1)
+	expectRows(t, rows, err, "user1")
+}
+
+func TestStatementCacheClearedByRegisterFunction(t *testing.T) {
+	s := stmtSQLizer(8)
+	stmt := prepare(t, s, stmtQuery)
+
+	err := s.RegisterFunction("shout", 1, "TEXT", func(args []reflect.Value) reflect.Value {
+		return reflect.ValueOf(strings.ToUpper(args[0].String()))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if prepare(t, s, stmtQuery) == stmt {
+		t.Fatal("expected registering a function to discard the prepared statements")
+	}
+
+	rows, err := s.ExecuteArgs("SELECT shout(username) FROM accounts WHERE id = ?", 1)
+	expectRows(t, rows, err, "USER1")
+}
+
+// queryConcurrently runs statement with each of args from several
+// goroutines at once, both through stmt and through the SQLizer, and checks
+// that each gives the rows it gives when run alone
+func queryConcurrently(t *testing.T, s *duckql.SQLizer, statement string, args ...any) {
+	t.Helper()
+
+	stmt := prepare(t, s, statement)
+
+	expected := make([]string, len(args))
+	for i, arg := range args {
+		rows, err := stmt.Query(arg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[i] = rows.String()
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*len(args))
+	for n := 0; n < cap(errs); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			i := n % len(args)
+
+			var rows duckql.ResultRows
+			var err error
+			if n%2 == 0 {
+				rows, err = stmt.Query(args[i])
+			} else {
+				rows, err = s.ExecuteArgs(statement, args[i])
+			}
+
+			switch {
+			case err != nil:
+				errs <- err
+			case rows.String() != expected[i]:
+				errs <- fmt.Errorf("%v: expected %q, got %q", args[i], expected[i], rows.String())
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestStmtConcurrentQueries(t *testing.T) {
+	queryConcurrently(t, stmtSQLizer(8),
+		"SELECT a.username, o.name, sum(a.id) OVER (ORDER BY a.id ROWS 1 PRECEDING) FROM organizations AS o RIGHT JOIN accounts AS a ON a.organization_id = o.id WHERE a.id >= ? ORDER BY a.id",
+		0, 1, 2, 3,
+	)
+}
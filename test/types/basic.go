@@ -35,3 +35,25 @@ type Transaction struct {
 type Message struct {
 	IsUser bool
 }
+
+type LineItem struct {
+	ID       int
+	Product  string
+	Price    float64
+	Quantity int
+}
+
+type Employee struct {
+	ID        int
+	Name      string
+	Nickname  *string
+	ManagerID *int
+	Salary    *float64
+}
+
+type Project struct {
+	Title          string
+	OrganizationID int
+	Budget         float64
+	Active         bool
+}
@@ -0,0 +1,97 @@
+package types
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/dburkart/duckql"
+)
+
+// RegisterFunction registers the sample function called name with s
+func RegisterFunction(s *duckql.SQLizer, name string) error {
+	switch name {
+	case "fiscal_quarter":
+		return s.RegisterFunction(name, 1, "TEXT", fiscalQuarter)
+	case "weighted_avg":
+		return s.RegisterAggregate(name, 2, "REAL", weightedAverage)
+	case "concat_all":
+		return s.RegisterFunction(name, -1, "TEXT", concatAll)
+	case "product":
+		return s.RegisterAccumulator(name, 1, "REAL", func() duckql.Accumulator { return &product{} })
+	}
+	return fmt.Errorf("no such function %q", name)
+}
+
+// fiscalQuarter returns the fiscal quarter of a time, where the fiscal year
+// begins in October
+func fiscalQuarter(args []reflect.Value) reflect.Value {
+	t, ok := args[0].Interface().(time.Time)
+	if !ok {
+		return reflect.Value{}
+	}
+
+	t = t.UTC().AddDate(0, 3, 0)
+	return reflect.ValueOf(fmt.Sprintf("FY%d Q%d", t.Year(), (int(t.Month())-1)/3+1))
+}
+
+func toFloat(v reflect.Value) float64 {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	}
+	return 0
+}
+
+// weightedAverage returns the average of its first argument weighted by its
+// second
+func weightedAverage(c *duckql.AggregateFunctionColumn, rows duckql.ResultRows) duckql.ResultRows {
+	var sum, weights float64
+	for _, row := range rows {
+		if !row[0].Value.IsValid() || !row[1].Value.IsValid() {
+			continue
+		}
+
+		sum += toFloat(row[0].Value) * toFloat(row[1].Value)
+		weights += toFloat(row[1].Value)
+	}
+
+	if weights == 0 {
+		return duckql.ResultRows{{{Name: "weighted_avg"}}}
+	}
+
+	return duckql.ResultRows{{{Name: "weighted_avg", Value: reflect.ValueOf(sum / weights)}}}
+}
+
+func concatAll(args []reflect.Value) reflect.Value {
+	var s string
+	for _, arg := range args {
+		if arg.IsValid() {
+			s += fmt.Sprint(arg.Interface())
+		}
+	}
+	return reflect.ValueOf(s)
+}
+
+// product is an accumulator which multiplies together the non-NULL values
+// of its argument
+type product struct {
+	result reflect.Value
+}
+
+func (p *product) Step(args []reflect.Value) {
+	if !args[0].IsValid() {
+		return
+	}
+
+	if !p.result.IsValid() {
+		p.result = reflect.ValueOf(1.0)
+	}
+	p.result = reflect.ValueOf(p.result.Float() * toFloat(args[0]))
+}
+
+func (p *product) Final() reflect.Value {
+	return p.result
+}
@@ -12,6 +12,9 @@ var typeMap = map[string]any{
 	"Organization": &Organization{},
 	"Transaction":  &Transaction{},
 	"Message":      &Message{},
+	"LineItem":     &LineItem{},
+	"Employee":     &Employee{},
+	"Project":      &Project{},
 }
 
 func TypeByName(name string) any {
@@ -43,6 +46,15 @@ func UnmarshallData(name string, b []byte) (any, error) {
 	case "Message":
 		var d []*Message
 		return d, json.Unmarshal(b, &d)
+	case "LineItem":
+		var d []*LineItem
+		return d, json.Unmarshal(b, &d)
+	case "Employee":
+		var d []*Employee
+		return d, json.Unmarshal(b, &d)
+	case "Project":
+		var d []*Project
+		return d, json.Unmarshal(b, &d)
 	}
 	return nil, fmt.Errorf("no such data type %q", name)
 }
@@ -2,20 +2,86 @@ package duckql
 
 import (
 	"errors"
+	"slices"
+	"strings"
+
 	"github.com/rqlite/sql"
 )
 
 type Validator struct {
 	s       *SQLizer
 	columns []string
+
+	// depth is the number of statements being visited, not counting the
+	// parts of a compound statement after the first, which are recorded in
+	// compounded
+	depth      int
+	compounded map[*sql.SelectStatement]bool
+
+	// ctes holds, for each statement with a WITH clause enclosing the one
+	// being visited, the columns of its common table expressions
+	ctes []map[string][]string
 }
 
 func (v *Validator) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
 	switch t := n.(type) {
+	case sql.SelectExpr:
+		if err := walkNested(v, t); err != nil {
+			return nil, nil, err
+		}
+
+	case *sql.WithClause:
+		// The statements of common table expressions are checked as the
+		// tables of the statement they belong to are, at its depth
+		v.depth--
+		err := walkNested(v, t)
+		v.depth++
+		if err != nil {
+			return nil, nil, err
+		}
+
 	case *sql.SelectStatement:
 		if v.s.Permissions&AllowSelectStatements == 0 {
 			return nil, nil, errors.New("duckql: SelectStatements are not allowed")
 		}
+
+		// The common table expressions of the statement may be named by
+		// any of its tables, including those of the expressions themselves
+		if t.WithClause != nil {
+			v.ctes = append(v.ctes, make(map[string][]string))
+			for _, cte := range t.WithClause.CTEs {
+				v.ctes[len(v.ctes)-1][cte.TableName.Name] = cteColumns(cte)
+			}
+		}
+
+		if t.Compound != nil {
+			if v.compounded == nil {
+				v.compounded = make(map[*sql.SelectStatement]bool)
+			}
+			v.compounded[t.Compound] = true
+		}
+
+		if !v.compounded[t] {
+			v.depth++
+		}
+
+		if t.WhereExpr != nil && v.s.containsAggregate(t.WhereExpr) {
+			return nil, nil, errors.New("duckql: misuse of aggregate function in WHERE clause")
+		}
+
+		for _, expr := range t.GroupByExprs {
+			if v.s.containsAggregate(expr) {
+				return nil, nil, errors.New("duckql: aggregate functions are not allowed in the GROUP BY clause")
+			}
+		}
+
+		// Window functions are computed once rows have been filtered and
+		// grouped
+		for _, expr := range append([]sql.Expr{t.WhereExpr, t.HavingExpr}, t.GroupByExprs...) {
+			if calls := windowCalls(expr); len(calls) > 0 {
+				return nil, nil, errors.New("duckql: misuse of window function " + calls[0].Name.Name + "()")
+			}
+		}
 	case *sql.InsertStatement:
 		if v.s.Permissions&AllowInsertStatements == 0 {
 			return nil, nil, errors.New("duckql: InsertStatements are not allowed")
@@ -39,7 +105,9 @@ func (v *Validator) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
 
 			// FIXME
 			if len(e.Args) > 0 {
-				underlyingColumn = e.Args[0].(*sql.Ident).Name
+				if ident, ok := e.Args[0].(*sql.Ident); ok {
+					underlyingColumn = ident.Name
+				}
 			} else {
 				underlyingColumn = "*"
 			}
@@ -47,17 +115,19 @@ func (v *Validator) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
 			v.columns = append(v.columns, underlyingColumn)
 		}
 
-	case *sql.QualifiedTableName:
-		if t.Alias != nil {
-			if table, ok := v.s.Tables[t.Name.Name]; ok {
-				v.s.Tables[t.Alias.Name] = table
-			} else {
-				return nil, nil, errors.New("duckql: table not found: " + t.Name.Name)
-			}
+	case *sql.Call:
+		if err := v.s.checkCall(t); err != nil {
+			return nil, nil, err
+		}
+
+	case *sql.OrderingTerm:
+		if t.Collation != nil && !slices.Contains(collations, strings.ToLower(t.Collation.Name.Name)) {
+			return nil, nil, errors.New("duckql: no such collation sequence: " + t.Collation.Name.Name)
 		}
 
-		if table, ok := v.s.Tables[t.TableName()]; !ok || table == nil {
-			return nil, nil, errors.New("duckql: Unknown table '" + t.TableName() + "'")
+	case *sql.QualifiedTableName:
+		if _, ok := v.tableColumns(t.Name.Name); !ok {
+			return nil, nil, errors.New("duckql: Unknown table '" + t.Name.Name + "'")
 		}
 	}
 
@@ -67,9 +137,23 @@ func (v *Validator) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
 func (v *Validator) VisitEnd(n sql.Node) (sql.Node, error) {
 	switch t := n.(type) {
 	case *sql.SelectStatement:
+		enclosing := v.depth - 1
+		if !v.compounded[t] {
+			v.depth--
+			enclosing = v.depth
+		}
+		if t.WithClause != nil {
+			defer func() { v.ctes = v.ctes[:len(v.ctes)-1] }()
+		}
+
 		source := t.Source
 
-		sourceTable, ok := source.(*sql.QualifiedTableName)
+		sourceTable, _ := source.(*sql.QualifiedTableName)
+		if enclosing > 0 {
+			// The columns of a subquery may belong to the statements
+			// enclosing it
+			sourceTable = nil
+		}
 		//sourceJoin, ok := t.Source.(*sql.JoinClause)
 
 		for _, column := range t.Columns {
@@ -80,18 +164,269 @@ func (v *Validator) VisitEnd(n sql.Node) (sql.Node, error) {
 				}
 
 				if sourceTable != nil {
-					table := v.s.Tables[sourceTable.TableName()]
-
-					if _, ok = table.ColumnMappings[e.Name]; !ok {
+					if !v.hasColumn(sourceTable, e.Name) {
 						return nil, errors.New("duckql: Unknown column '" + e.Name + "' for table '" + sourceTable.TableName() + "'")
 					}
 				}
 
 			case *sql.QualifiedRef:
+				if sourceTable == nil {
+					continue
+				}
+
+				if e.Table.Name != sourceTable.TableName() && e.Table.Name != sourceTable.Name.Name {
+					return nil, errors.New("duckql: Unknown table '" + e.Table.Name + "'")
+				}
+
+				if e.Column != nil {
+					if !v.hasColumn(sourceTable, e.Column.Name) {
+						return nil, errors.New("duckql: Unknown column '" + e.Column.Name + "' for table '" + sourceTable.TableName() + "'")
+					}
+				}
+			}
+		}
+
+		if join, ok := source.(*sql.JoinClause); ok {
+			if err := v.checkAmbiguity(t, join); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, expr := range t.GroupByExprs {
+			if e, ok := expr.(*sql.Ident); ok && sourceTable != nil {
+				if !v.hasColumn(sourceTable, e.Name) && !hasAlias(t.Columns, e.Name) {
+					return nil, errors.New("duckql: Unknown column '" + e.Name + "' for table '" + sourceTable.TableName() + "'")
+				}
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// cteColumns returns the columns of a common table expression, which are
+// either listed after its name or named by the result columns of its first
+// SELECT. They are nil if they cannot be known before the expression is
+// evaluated, as when it selects '*'.
+func cteColumns(cte *sql.CTE) []string {
+	var columns []string
+	for _, column := range cte.Columns {
+		columns = append(columns, column.Name)
+	}
+
+	if len(columns) > 0 {
+		return columns
+	}
+
+	for _, column := range cte.Select.Columns {
+		if column.Star.IsValid() {
+			return nil
+		}
+
+		if ref, ok := column.Expr.(*sql.QualifiedRef); ok && ref.Star.IsValid() {
+			return nil
+		}
+
+		columns = append(columns, columnName(column))
+	}
+
+	return columns
+}
+
+// tableColumns returns the columns of the table named name, which is
+// either a common table expression in scope or a table of the SQLizer. ok
+// is false if there is no such table, and the columns are nil if they are
+// not known.
+func (v *Validator) tableColumns(name string) (columns []string, ok bool) {
+	for idx := len(v.ctes) - 1; idx >= 0; idx-- {
+		if columns, ok := v.ctes[idx][name]; ok {
+			return columns, true
+		}
+	}
 
+	if table, ok := v.s.Tables[name]; ok && table != nil {
+		return table.Columns, true
+	}
+
+	return nil, false
+}
+
+// hasColumn reports whether the table named by source has a column named
+// column. A common table expression whose columns are not known is assumed
+// to have every column.
+func (v *Validator) hasColumn(source *sql.QualifiedTableName, column string) bool {
+	columns, ok := v.tableColumns(source.Name.Name)
+	return !ok || columns == nil || slices.Contains(columns, column)
+}
+
+// hasAlias reports whether any of the result columns is aliased as name
+func hasAlias(columns []*sql.ResultColumn, name string) bool {
+	for _, column := range columns {
+		if column.Alias != nil && column.Alias.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// columnFinder is a sql.Visitor which collects the column references in an
+// expression, without descending into subqueries
+type columnFinder struct {
+	idents []*sql.Ident
+	refs   []*sql.QualifiedRef
+}
+
+func (f *columnFinder) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
+	switch t := n.(type) {
+	case *sql.Ident:
+		f.idents = append(f.idents, t)
+		return nil, n, nil
+	case *sql.QualifiedRef:
+		f.refs = append(f.refs, t)
+		return nil, n, nil
+	case *sql.Type, *sql.SelectStatement, *sql.Exists:
+		return nil, n, nil
+	case *sql.Call:
+		// The name of the function is not a column
+		for _, arg := range t.Args {
+			if _, err := sql.Walk(f, arg); err != nil {
+				return nil, nil, err
 			}
 		}
+		return nil, n, nil
 	}
 
+	return f, n, nil
+}
+
+func (f *columnFinder) VisitEnd(n sql.Node) (sql.Node, error) {
 	return n, nil
 }
+
+// joinScope returns, for each column name, the number of tables in a join
+// with a column of that name, counting columns merged by USING or NATURAL
+// once, along with the number of tables referred to by each name. ok is
+// false if any source of the join is not a table, or is a common table
+// expression whose columns are not known.
+func (v *Validator) joinScope(join *sql.JoinClause) (columns, names map[string]int, ok bool) {
+	columns, names = make(map[string]int), make(map[string]int)
+
+	first, steps := flattenJoin(join)
+	sources := []sql.Source{first}
+	for _, step := range steps {
+		sources = append(sources, step.source)
+	}
+
+	for idx, source := range sources {
+		name, ok := source.(*sql.QualifiedTableName)
+		if !ok {
+			return nil, nil, false
+		}
+
+		tableColumns, ok := v.tableColumns(name.Name.Name)
+		if !ok || tableColumns == nil {
+			return nil, nil, false
+		}
+		names[name.TableName()]++
+
+		merged := make(map[string]bool)
+		if idx > 0 {
+			step := steps[idx-1]
+			if using, ok := step.constraint.(*sql.UsingConstraint); ok {
+				for _, column := range using.Columns {
+					merged[column.Name] = true
+				}
+			} else if step.operator.Natural.IsValid() {
+				for _, column := range tableColumns {
+					merged[column] = true
+				}
+			}
+		}
+
+		for _, column := range tableColumns {
+			if !merged[column] || columns[column] == 0 {
+				columns[column]++
+			}
+		}
+	}
+
+	return columns, names, true
+}
+
+// checkAmbiguity reports an error, as SQLite does, for any unqualified
+// reference to a column which more than one table of a join has, and for
+// any qualified reference to a table name which appears more than once.
+// Result column aliases may be referred to by ORDER BY, GROUP BY and
+// HAVING, where they take precedence over the columns of the tables.
+func (v *Validator) checkAmbiguity(t *sql.SelectStatement, join *sql.JoinClause) error {
+	columns, names, ok := v.joinScope(join)
+	if !ok {
+		return nil
+	}
+
+	check := func(expr sql.Expr, aliases bool) error {
+		if expr == nil {
+			return nil
+		}
+
+		var f columnFinder
+		if _, err := sql.Walk(&f, expr); err != nil {
+			return err
+		}
+
+		for _, ident := range f.idents {
+			if aliases && hasAlias(t.Columns, ident.Name) {
+				continue
+			}
+
+			if columns[ident.Name] > 1 {
+				return errors.New("duckql: ambiguous column name: " + ident.Name)
+			}
+		}
+
+		for _, ref := range f.refs {
+			if names[ref.Table.Name] > 1 {
+				column := "*"
+				if ref.Column != nil {
+					column = ref.Column.Name
+				}
+				return errors.New("duckql: ambiguous column name: " + ref.Table.Name + "." + column)
+			}
+		}
+
+		return nil
+	}
+
+	var exprs []sql.Expr
+	for _, column := range t.Columns {
+		exprs = append(exprs, column.Expr)
+	}
+	exprs = append(exprs, t.WhereExpr)
+
+	_, steps := flattenJoin(join)
+	for _, step := range steps {
+		if on, ok := step.constraint.(*sql.OnConstraint); ok {
+			exprs = append(exprs, on.X)
+		}
+	}
+
+	for _, expr := range exprs {
+		if err := check(expr, false); err != nil {
+			return err
+		}
+	}
+
+	exprs = append([]sql.Expr{t.HavingExpr}, t.GroupByExprs...)
+	for _, term := range t.OrderingTerms {
+		exprs = append(exprs, term.X)
+	}
+
+	for _, expr := range exprs {
+		if err := check(expr, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package duckql
+
+import "github.com/rqlite/sql"
+
+// walkAll walks n as sql.Walk does, but also descends into the statements
+// which sql.Walk does not, those of subqueries used as expressions and of
+// common table expressions
+func walkAll(v sql.Visitor, n sql.Node) (sql.Node, error) {
+	return sql.Walk(nestedVisitor{v}, n)
+}
+
+// nestedVisitor visits nodes with v, walking the statements nested in each
+// node it visits
+type nestedVisitor struct {
+	v sql.Visitor
+}
+
+func (w nestedVisitor) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
+	v, n, err := w.v.Visit(n)
+	if err != nil || v == nil {
+		return nil, n, err
+	}
+
+	w = nestedVisitor{v}
+	if err := walkNested(w, n); err != nil {
+		return nil, nil, err
+	}
+
+	return w, n, nil
+}
+
+func (w nestedVisitor) VisitEnd(n sql.Node) (sql.Node, error) {
+	return w.v.VisitEnd(n)
+}
+
+// walkNested walks the statements nested in n which sql.Walk does not
+// descend into: the statement of a subquery used as an expression, and
+// those of the common table expressions of a WITH clause. A visitor which
+// is walked by sql.Walk may call it as it visits each node.
+func walkNested(v sql.Visitor, n sql.Node) error {
+	switch t := n.(type) {
+	case sql.SelectExpr:
+		_, err := sql.Walk(v, t.SelectStatement)
+		return err
+	case *sql.WithClause:
+		for _, cte := range t.CTEs {
+			if _, err := sql.Walk(v, cte.Select); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// collectNodes returns the nodes of type T in n, including those of the
+// statements nested in it, in the order in which they are walked
+func collectNodes[T sql.Node](n sql.Node) []T {
+	var nodes []T
+	_, _ = walkAll(sql.VisitFunc(func(n sql.Node) (sql.Node, error) {
+		if t, ok := n.(T); ok {
+			nodes = append(nodes, t)
+		}
+		return n, nil
+	}), n)
+
+	return nodes
+}
+
+// cloneStatement returns a copy of the statement n. sql.CloneStatement
+// copies the second bound of a frame in place of the first, leaving the
+// copy sharing the second, so the bounds of each frame are copied again.
+func cloneStatement(n sql.Node) sql.Node {
+	c := sql.CloneStatement(n.(sql.Statement))
+
+	frames, copied := collectNodes[*sql.FrameSpec](n), collectNodes[*sql.FrameSpec](c)
+	for i, frame := range frames {
+		copied[i].X, copied[i].Y = sql.CloneExpr(frame.X), sql.CloneExpr(frame.Y)
+	}
+
+	return c
+}
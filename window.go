@@ -0,0 +1,731 @@
+package duckql
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/rqlite/sql"
+)
+
+// windowFunction is an entry in the registry of functions which may only be
+// called as window functions, along with the number of arguments it
+// accepts. function returns the value of the function for the row at index
+// idx of a partition, given the values of the arguments for every row.
+type windowFunction struct {
+	minArgs  int
+	maxArgs  int
+	function func(p *windowPartition, args [][]reflect.Value, idx int) reflect.Value
+}
+
+var windowFunctionMap = map[string]windowFunction{
+	"cume_dist":    {0, 0, cumeDistFunction},
+	"dense_rank":   {0, 0, denseRankFunction},
+	"first_value":  {1, 1, firstValueFunction},
+	"lag":          {1, 3, lagFunction(-1)},
+	"last_value":   {1, 1, lastValueFunction},
+	"lead":         {1, 3, lagFunction(1)},
+	"nth_value":    {2, 2, nthValueFunction},
+	"ntile":        {1, 1, ntileFunction},
+	"percent_rank": {0, 0, percentRankFunction},
+	"rank":         {0, 0, rankFunction},
+	"row_number":   {0, 0, rowNumberFunction},
+}
+
+// windowPartition is a partition of the rows given to a window function,
+// sorted by the ORDER BY terms of its window. indexes holds the position of
+// each row among all of the rows.
+type windowPartition struct {
+	exec    *QueryExecutor
+	def     *sql.WindowDefinition
+	rows    []sourceRow
+	indexes []int
+
+	// keys holds the values of the ORDER BY terms for each row, and peers
+	// the index of the group of rows which are equal under those terms
+	// that each row belongs to. starts holds the index of the first row
+	// of each group.
+	keys   [][]reflect.Value
+	peers  []int
+	starts []int
+
+	// frame gives the frame of each row, which is every row up to the last
+	// peer of the row if the window has no frame specification
+	frame func(idx int) windowFrame
+}
+
+// checkWindowCall reports an error if call, which has an OVER clause, is
+// not a call to a window function or to an aggregate function, or passes
+// it the wrong number of arguments
+func (s *SQLizer) checkWindowCall(call *sql.Call) error {
+	name := strings.ToLower(call.Name.Name)
+
+	if call.Distinct.IsValid() {
+		return errors.New("duckql: DISTINCT is not supported for window functions")
+	}
+
+	if f, ok := windowFunctionMap[name]; ok {
+		if _, registered := s.registeredFunction(name); !registered {
+			if call.Filter != nil {
+				return errors.New("duckql: FILTER clause may only be used with aggregate window functions")
+			}
+			if call.Star.Line != 0 || len(call.Args) < f.minArgs || len(call.Args) > f.maxArgs {
+				return errors.New("duckql: wrong number of arguments to function " + call.Name.Name + "()")
+			}
+			return nil
+		}
+	}
+
+	aggregate := *call
+	aggregate.Over = nil
+	if !s.isAggregateCall(&aggregate) {
+		return errors.New("duckql: " + call.Name.Name + "() may not be used as a window function")
+	}
+
+	return s.checkCall(&aggregate)
+}
+
+// windowCalls returns the calls to window functions made by exprs, other
+// than those made by their subqueries
+func windowCalls(exprs ...sql.Expr) []*sql.Call {
+	var calls []*sql.Call
+
+	find := sql.VisitFunc(func(n sql.Node) (sql.Node, error) {
+		if call, ok := n.(*sql.Call); ok && call.Over != nil && !slices.Contains(calls, call) {
+			calls = append(calls, call)
+		}
+		return n, nil
+	})
+
+	for _, expr := range exprs {
+		if expr != nil {
+			_, _ = sql.Walk(&subqueryStopper{find}, expr)
+		}
+	}
+
+	return calls
+}
+
+// subqueryStopper is a sql.Visitor which passes every node to v, other than
+// those of subqueries
+type subqueryStopper struct {
+	v sql.VisitFunc
+}
+
+func (s *subqueryStopper) Visit(n sql.Node) (sql.Visitor, sql.Node, error) {
+	if _, ok := n.(*sql.SelectStatement); ok {
+		return nil, n, nil
+	}
+
+	n, err := s.v(n)
+	return s, n, err
+}
+
+func (s *subqueryStopper) VisitEnd(n sql.Node) (sql.Node, error) {
+	return n, nil
+}
+
+// containsWindow reports whether n calls a window function
+func containsWindow(n sql.Expr) bool {
+	return len(windowCalls(n)) > 0
+}
+
+// window computes the value of each of the window functions calls for
+// every one of rows. The values are added to the end of each row, past its
+// columns, at the index which the row's table records for the call.
+func (q *QueryExecutor) window(rows []sourceRow, calls []*sql.Call) {
+	if len(calls) == 0 || len(rows) == 0 {
+		return
+	}
+
+	values := make([][]reflect.Value, len(rows))
+	for idx := range values {
+		values[idx] = make([]reflect.Value, len(calls))
+	}
+
+	for c, call := range calls {
+		for _, p := range q.partitions(rows, q.windowDefinition(call.Over)) {
+			results := p.call(call)
+			for idx, index := range p.indexes {
+				values[index][c] = results[idx]
+			}
+		}
+	}
+
+	indexes := make(map[*sql.Call]int)
+	for idx, row := range rows {
+		width := len(row.table.Columns)
+		for c, call := range calls {
+			indexes[call] = width + c
+		}
+
+		extended := make(ResultRow, width, width+len(calls))
+		copy(extended, row.row[:width])
+		for _, v := range values[idx] {
+			extended = append(extended, ResultValue{Value: v})
+		}
+
+		rows[idx].row = extended
+		row.table.windows = indexes
+	}
+}
+
+// windowDefinition returns the definition of the window named or given by
+// over, combining any window it is based on with its own terms as SQLite
+// does
+func (q *QueryExecutor) windowDefinition(over *sql.OverClause) *sql.WindowDefinition {
+	def := over.Definition
+	name := over.Name
+	if def != nil {
+		name = def.Base
+	}
+
+	if name == nil {
+		if def == nil {
+			return &sql.WindowDefinition{}
+		}
+		return def
+	}
+
+	var base *sql.WindowDefinition
+	for _, w := range q.windows {
+		if w.Name.Name == name.Name {
+			base = q.windowDefinition(&sql.OverClause{Definition: w.Definition})
+		}
+	}
+
+	if base == nil {
+		raise("no such window: %s", name.Name)
+	}
+
+	if def == nil {
+		return base
+	}
+
+	switch {
+	case len(def.Partitions) > 0:
+		raise("cannot override PARTITION clause of window: %s", name.Name)
+	case len(def.OrderingTerms) > 0 && len(base.OrderingTerms) > 0:
+		raise("cannot override ORDER BY clause of window: %s", name.Name)
+	case base.Frame != nil:
+		raise("cannot override frame specification of window: %s", name.Name)
+	}
+
+	merged := *def
+	merged.Partitions = base.Partitions
+	if len(def.OrderingTerms) == 0 {
+		merged.OrderingTerms = base.OrderingTerms
+	}
+
+	return &merged
+}
+
+// partitions divides rows into the partitions of the window def, in the
+// order in which the first row of each appears, and sorts each partition
+func (q *QueryExecutor) partitions(rows []sourceRow, def *sql.WindowDefinition) []*windowPartition {
+	var partitions []*windowPartition
+	byKey := make(map[string]*windowPartition)
+
+	for idx, row := range rows {
+		q.e.checkContext()
+
+		var key strings.Builder
+		for _, expr := range def.Partitions {
+			key.WriteString(valueKey(row.evaluate(expr)))
+			key.WriteByte(0)
+		}
+
+		p, ok := byKey[key.String()]
+		if !ok {
+			p = &windowPartition{exec: q, def: def}
+			byKey[key.String()] = p
+			partitions = append(partitions, p)
+		}
+
+		p.indexes = append(p.indexes, idx)
+	}
+
+	for _, p := range partitions {
+		keys := make(map[int][]reflect.Value)
+		for _, idx := range p.indexes {
+			for _, term := range def.OrderingTerms {
+				keys[idx] = append(keys[idx], rows[idx].evaluate(term.X))
+			}
+		}
+
+		slices.SortStableFunc(p.indexes, func(a, b int) int {
+			return compareOrdering(def.OrderingTerms, keys[a], keys[b])
+		})
+
+		for n, idx := range p.indexes {
+			p.rows = append(p.rows, rows[idx])
+			p.keys = append(p.keys, keys[idx])
+
+			if n == 0 || compareOrdering(def.OrderingTerms, keys[p.indexes[n-1]], keys[idx]) != 0 {
+				p.starts = append(p.starts, n)
+			}
+			p.peers = append(p.peers, len(p.starts)-1)
+		}
+	}
+
+	return partitions
+}
+
+// call returns the value of the window function called by call for each row
+// of the partition
+func (p *windowPartition) call(call *sql.Call) []reflect.Value {
+	name := strings.ToLower(call.Name.Name)
+
+	args := make([][]reflect.Value, len(p.rows))
+	for idx, row := range p.rows {
+		args[idx] = make([]reflect.Value, len(call.Args))
+		for a, arg := range call.Args {
+			args[idx][a] = row.evaluate(arg)
+		}
+	}
+
+	p.frame = p.frameFunction()
+
+	results := make([]reflect.Value, len(p.rows))
+
+	if f, ok := windowFunctionMap[name]; ok {
+		if _, registered := p.exec.s.registeredFunction(name); !registered {
+			for idx := range p.rows {
+				results[idx] = f.function(p, args, idx)
+			}
+			return results
+		}
+	}
+
+	// Any other function is an aggregate, computed across each row's frame
+	aggregate := *call
+	aggregate.Over = nil
+
+	var init func() Accumulator
+	skipNull := true
+	if f, ok := p.exec.s.registeredFunction(name); ok && f.aggregate != nil {
+		init = func() Accumulator { return f.aggregate(&aggregate) }
+		skipNull = false
+	} else if f, ok := functionMap[name]; ok && p.exec.s.isAggregateCall(&aggregate) {
+		if call.Star.Line == 0 || name != "count" {
+			checkArity(call, f.minArgs, f.maxArgs)
+		}
+		init = f.init
+	} else {
+		raise("%s() may not be used as a window function", call.Name.Name)
+	}
+
+	// Rows for which the FILTER clause is not true are left out of every
+	// frame
+	filtered := make([]bool, len(p.rows))
+	if call.Filter != nil {
+		for idx, row := range p.rows {
+			filtered[idx] = !isTrue(row.evaluate(call.Filter.X))
+		}
+	}
+
+	// While each row's frame begins where the last one's did and ends no
+	// sooner, the rows added to it are stepped through the same
+	// accumulator rather than starting again
+	var acc Accumulator
+	var last windowFrame
+	stepped := -1
+	for idx := range p.rows {
+		f := p.frame(idx)
+		if acc == nil || f.excluding() || f.start != last.start || f.end < stepped {
+			acc = init()
+			stepped = f.start - 1
+		}
+
+		for n := stepped + 1; n <= f.end; n++ {
+			if f.excludes(n) || filtered[n] || (skipNull && len(args[n]) > 0 && !args[n][0].IsValid()) {
+				continue
+			}
+			acc.Step(args[n])
+		}
+		stepped = max(stepped, f.end)
+
+		results[idx] = acc.Final()
+		last = f
+	}
+
+	return results
+}
+
+// groupEnd returns the index of the last row of the group of peers g
+func (p *windowPartition) groupEnd(g int) int {
+	if g+1 < len(p.starts) {
+		return p.starts[g+1] - 1
+	}
+
+	return len(p.rows) - 1
+}
+
+// windowFrame is the frame of a row: the rows of its partition from start
+// to end, which an aggregate or value function is computed across. The
+// rows from excludeFrom to excludeTo, other than keep, are left out.
+type windowFrame struct {
+	start, end             int
+	excludeFrom, excludeTo int
+	keep                   int
+}
+
+func (f windowFrame) excluding() bool {
+	return f.excludeFrom <= f.excludeTo
+}
+
+func (f windowFrame) excludes(n int) bool {
+	return n >= f.excludeFrom && n <= f.excludeTo && n != f.keep
+}
+
+// frameBound is one end of a frame specification. A bound which is neither
+// unbounded nor the current row is offset rows, groups or values before
+// or after the current row.
+type frameBound struct {
+	unbounded bool
+	current   bool
+	preceding bool
+	offset    reflect.Value
+}
+
+// frameFunction checks the window's frame specification, returning a
+// function giving the frame of a row
+func (p *windowPartition) frameFunction() func(idx int) windowFrame {
+	spec := p.def.Frame
+	if spec == nil {
+		return func(idx int) windowFrame {
+			return windowFrame{end: p.groupEnd(p.peers[idx]), excludeTo: -1, keep: -1}
+		}
+	}
+
+	start := frameBound{
+		unbounded: spec.UnboundedX.IsValid(),
+		current:   spec.CurrentX.IsValid(),
+		preceding: spec.PrecedingX.IsValid(),
+	}
+	end := frameBound{current: true}
+	if spec.Between.IsValid() {
+		end = frameBound{
+			unbounded: spec.UnboundedY.IsValid(),
+			current:   spec.CurrentY.IsValid(),
+			preceding: spec.PrecedingY.IsValid(),
+		}
+	}
+
+	switch {
+	case start.unbounded && !start.preceding, end.unbounded && end.preceding:
+		raise("unsupported frame specification")
+	case start.current && !end.unbounded && end.preceding:
+		raise("unsupported frame specification")
+	case !start.current && !start.preceding && !end.unbounded && (end.current || end.preceding):
+		raise("unsupported frame specification")
+	}
+
+	ranged := spec.Range.IsValid()
+	if ranged && (!start.unbounded && !start.current || !end.unbounded && !end.current) && len(p.def.OrderingTerms) != 1 {
+		raise("RANGE with offset PRECEDING/FOLLOWING requires one ORDER BY expression")
+	}
+
+	if !start.unbounded && !start.current {
+		start.offset = p.frameOffset(spec.X, ranged, "starting")
+	}
+	if !end.unbounded && !end.current {
+		end.offset = p.frameOffset(spec.Y, ranged, "ending")
+	}
+
+	var bound func(b frameBound, idx int, isStart bool) int
+	switch {
+	case spec.Groups.IsValid():
+		bound = p.groupsBound
+	case ranged:
+		bound = p.rangeBound
+	default:
+		bound = p.rowsBound
+	}
+
+	return func(idx int) windowFrame {
+		f := windowFrame{
+			start:     bound(start, idx, true),
+			end:       bound(end, idx, false),
+			excludeTo: -1,
+			keep:      -1,
+		}
+
+		group := p.peers[idx]
+		switch {
+		case spec.ExcludeCurrentRow.IsValid():
+			f.excludeFrom, f.excludeTo = idx, idx
+		case spec.ExcludeGroup.IsValid():
+			f.excludeFrom, f.excludeTo = p.starts[group], p.groupEnd(group)
+		case spec.ExcludeTies.IsValid():
+			f.excludeFrom, f.excludeTo, f.keep = p.starts[group], p.groupEnd(group), idx
+		}
+
+		return f
+	}
+}
+
+// frameOffset evaluates the offset of a frame bound, which must be a
+// non-negative integer, or for a RANGE frame any non-negative number
+func (p *windowPartition) frameOffset(expr sql.Expr, ranged bool, which string) reflect.Value {
+	table := &IntermediateTable{sqlizer: p.exec.s, now: p.exec.now, exec: p.exec}
+	v := table.evaluate(expr, nil)
+
+	if ranged {
+		if f := coerceToFloat(v); f == nil || *f < 0 {
+			raise("frame %s offset must be a non-negative number", which)
+		}
+		return v
+	}
+
+	if i := coerceToInt(v); i == nil || *i < 0 {
+		raise("frame %s offset must be a non-negative integer", which)
+	}
+
+	return v
+}
+
+// rowsBound returns the index of the row at which a ROWS frame starts or
+// ends
+func (p *windowPartition) rowsBound(b frameBound, idx int, isStart bool) int {
+	switch {
+	case b.unbounded && isStart:
+		return 0
+	case b.unbounded:
+		return len(p.rows) - 1
+	case b.current:
+		return idx
+	}
+
+	offset := int(*coerceToInt(b.offset))
+	if b.preceding {
+		offset = -offset
+	}
+
+	if isStart {
+		return max(idx+offset, 0)
+	}
+
+	return min(idx+offset, len(p.rows)-1)
+}
+
+// groupsBound returns the index of the row at which a GROUPS frame starts
+// or ends, which is the first or last row of a group of peers
+func (p *windowPartition) groupsBound(b frameBound, idx int, isStart bool) int {
+	group := p.peers[idx]
+	switch {
+	case b.unbounded && isStart:
+		return 0
+	case b.unbounded:
+		return len(p.rows) - 1
+	case !b.current:
+		offset := int(*coerceToInt(b.offset))
+		if b.preceding {
+			offset = -offset
+		}
+		group += offset
+	}
+
+	switch {
+	case group < 0 && isStart:
+		return 0
+	case group < 0:
+		return -1
+	case group >= len(p.starts) && isStart:
+		return len(p.rows)
+	case group >= len(p.starts):
+		return len(p.rows) - 1
+	case isStart:
+		return p.starts[group]
+	}
+
+	return p.groupEnd(group)
+}
+
+// rangeBound returns the index of the row at which a RANGE frame starts or
+// ends. An offset bound includes the rows whose ORDER BY value is within
+// the offset of the current row's, or the row's peers if its value is NULL.
+func (p *windowPartition) rangeBound(b frameBound, idx int, isStart bool) int {
+	group := p.peers[idx]
+	key := p.keys[idx][0]
+
+	switch {
+	case b.unbounded && isStart:
+		return 0
+	case b.unbounded:
+		return len(p.rows) - 1
+	case b.current || !key.IsValid():
+		if isStart {
+			return p.starts[group]
+		}
+		return p.groupEnd(group)
+	}
+
+	// Positions increase along the order of the partition
+	sign := 1.0
+	if p.def.OrderingTerms[0].Desc.IsValid() {
+		sign = -1
+	}
+	position := func(n int) float64 {
+		return sign * toNumeric(p.keys[n][0]).float()
+	}
+
+	offset := *coerceToFloat(b.offset)
+	if b.preceding {
+		offset = -offset
+	}
+	target := position(idx) + offset
+
+	if isStart {
+		for n := range p.rows {
+			if p.keys[n][0].IsValid() && position(n) >= target {
+				return n
+			}
+		}
+		return len(p.rows)
+	}
+
+	for n := len(p.rows) - 1; n >= 0; n-- {
+		if p.keys[n][0].IsValid() && position(n) <= target {
+			return n
+		}
+	}
+	return -1
+}
+
+// rowNumberFunction implements row_number(), the position of the row in its
+// partition
+func rowNumberFunction(p *windowPartition, args [][]reflect.Value, idx int) reflect.Value {
+	return reflect.ValueOf(int64(idx + 1))
+}
+
+// rankFunction implements rank(), the row_number() of the row's first peer
+func rankFunction(p *windowPartition, args [][]reflect.Value, idx int) reflect.Value {
+	return reflect.ValueOf(int64(p.starts[p.peers[idx]] + 1))
+}
+
+// denseRankFunction implements dense_rank(), the number of the row's group
+// of peers
+func denseRankFunction(p *windowPartition, args [][]reflect.Value, idx int) reflect.Value {
+	return reflect.ValueOf(int64(p.peers[idx] + 1))
+}
+
+// percentRankFunction implements percent_rank(), which scales rank() to
+// between 0.0 and 1.0
+func percentRankFunction(p *windowPartition, args [][]reflect.Value, idx int) reflect.Value {
+	if len(p.rows) < 2 {
+		return reflect.ValueOf(0.0)
+	}
+
+	return reflect.ValueOf(float64(p.starts[p.peers[idx]]) / float64(len(p.rows)-1))
+}
+
+// cumeDistFunction implements cume_dist(), the fraction of the partition's
+// rows which are up to the row's last peer
+func cumeDistFunction(p *windowPartition, args [][]reflect.Value, idx int) reflect.Value {
+	return reflect.ValueOf(float64(p.groupEnd(p.peers[idx])+1) / float64(len(p.rows)))
+}
+
+// ntileFunction implements ntile(n), which divides the partition into n
+// groups as evenly as possible, with any larger groups first, and returns
+// the number of the row's group
+func ntileFunction(p *windowPartition, args [][]reflect.Value, idx int) reflect.Value {
+	f := coerceToFloat(args[idx][0])
+	if f == nil || *f < 1 {
+		raise("argument of ntile must be a positive integer")
+	}
+
+	n := int(*f)
+	if n >= len(p.rows) {
+		return reflect.ValueOf(int64(idx + 1))
+	}
+
+	size := len(p.rows) / n
+	large := len(p.rows) % n * (size + 1)
+	if idx < large {
+		return reflect.ValueOf(int64(idx/(size+1) + 1))
+	}
+
+	return reflect.ValueOf(int64((idx-large)/size + len(p.rows)%n + 1))
+}
+
+// lagFunction returns the implementation of lag(x[, offset[, default]]) or
+// of lead(), which are the value of x for the row offset rows (by default,
+// one) before or after the row in its partition, or default if there is no
+// such row
+func lagFunction(direction int) func(p *windowPartition, args [][]reflect.Value, idx int) reflect.Value {
+	return func(p *windowPartition, args [][]reflect.Value, idx int) reflect.Value {
+		offset := int64(1)
+		if len(args[idx]) > 1 {
+			v := toNumeric(args[idx][1])
+			if !v.isInt {
+				return null
+			}
+			offset = v.i
+		}
+
+		if target := int64(idx) + int64(direction)*offset; target >= 0 && target < int64(len(p.rows)) {
+			return args[target][0]
+		}
+
+		if len(args[idx]) > 2 {
+			return args[idx][2]
+		}
+
+		return null
+	}
+}
+
+// frameRows returns the indices of the rows in the frame of the row at
+// index idx
+func (p *windowPartition) frameRows(idx int) []int {
+	f := p.frame(idx)
+
+	var rows []int
+	for n := f.start; n <= f.end; n++ {
+		if !f.excludes(n) {
+			rows = append(rows, n)
+		}
+	}
+
+	return rows
+}
+
+// firstValueFunction implements first_value(x), the value of x for the
+// first row of the row's frame
+func firstValueFunction(p *windowPartition, args [][]reflect.Value, idx int) reflect.Value {
+	rows := p.frameRows(idx)
+	if len(rows) == 0 {
+		return null
+	}
+
+	return args[rows[0]][0]
+}
+
+// lastValueFunction implements last_value(x), the value of x for the last
+// row of the row's frame
+func lastValueFunction(p *windowPartition, args [][]reflect.Value, idx int) reflect.Value {
+	rows := p.frameRows(idx)
+	if len(rows) == 0 {
+		return null
+	}
+
+	return args[rows[len(rows)-1]][0]
+}
+
+// nthValueFunction implements nth_value(x, n), the value of x for the nth
+// row of the row's frame, or NULL if the frame has fewer rows
+func nthValueFunction(p *windowPartition, args [][]reflect.Value, idx int) reflect.Value {
+	v := toNumeric(args[idx][1])
+	if !v.isInt || v.i < 1 {
+		raise("second argument to nth_value must be a positive integer")
+	}
+
+	rows := p.frameRows(idx)
+	if v.i > int64(len(rows)) {
+		return null
+	}
+
+	return args[rows[v.i-1]][0]
+}